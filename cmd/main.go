@@ -3,18 +3,34 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 
+	"chat_tool/entity"
 	"chat_tool/ui"
 )
 
 const (
 	Version             = "1.0.0-Dev"
 	BroadcastChanBuffer = 10
+	HistoryMaxAge       = 30 * 24 * time.Hour
+	HistoryMaxCount     = 1000
+	LivenessInterval    = time.Second
+	PeerSuspectAfter    = 5 * time.Second
+	PeerDeadAfter       = 20 * time.Second
+	PeerProbeTimeout    = 2 * time.Second
 )
 
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
-	if err := ui.NewApp(BroadcastChanBuffer).Run(ctx, Version); err != nil {
+	if err := ui.NewApp(BroadcastChanBuffer, entity.Retention{
+		MaxAge:   HistoryMaxAge,
+		MaxCount: HistoryMaxCount,
+	}, entity.Liveness{
+		Interval:     LivenessInterval,
+		SuspectAfter: PeerSuspectAfter,
+		DeadAfter:    PeerDeadAfter,
+		ProbeTimeout: PeerProbeTimeout,
+	}).Run(ctx, Version); err != nil {
 		log.Fatal(err)
 	}
 	cancel()
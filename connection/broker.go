@@ -11,32 +11,64 @@ import (
 )
 
 const (
-	Frequency  = 1 * time.Second
-	bufferSize = 8192
+	Frequency        = 1 * time.Second
+	bufferSize       = entity.MaxBroadcastSize
+	discoveryMaxSkew = 5 * time.Minute
 )
 
 type Broker struct {
 	owner     *entity.Owner
+	liveness  entity.Liveness
 	p2p       *P2PChannel
 	broadcast *BroadcastChannel
+	cancel    context.CancelFunc
 }
 
-func NewBroker(o *entity.Owner, broadcastIP string) *Broker {
+func NewBroker(o *entity.Owner, broadcastIP string, realm *utils.Realm, liveness entity.Liveness) *Broker {
 	broadcastAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%s", broadcastIP, o.Port))
 	if err != nil {
 		utils.LL.Error("Broker: %s", err.Error())
 		return nil
 	}
 	utils.LL.Info("Broker: ResolveUDPAddr [yellow]%s:%s[white]", broadcastIP, o.Port)
+	p2p := NewP2PChannel(fmt.Sprintf("0.0.0.0:%s", o.Port), o)
 	return &Broker{
 		owner:     o,
-		p2p:       NewP2PChannel(fmt.Sprintf("0.0.0.0:%s", o.Port), o),
-		broadcast: NewBroadcastChannel(broadcastAddr, Frequency, o),
+		liveness:  liveness,
+		p2p:       p2p,
+		broadcast: NewBroadcastChannel(broadcastAddr, Frequency, o, realm, p2p.HandleFrame),
 	}
 }
 
 func (m *Broker) Start(ctx context.Context) {
 	utils.LL.Info("Broker: START")
+	ctx, m.cancel = context.WithCancel(ctx)
 	go m.p2p.Start(ctx)
 	go m.broadcast.Start(ctx)
+	go m.owner.Repo.Watch(ctx, m.liveness)
+}
+
+func (m *Broker) Stop(ctx context.Context) {
+	utils.LL.Info("Broker: STOP")
+	if pending := m.owner.Repo.Drain(ctx); pending > 0 {
+		utils.LL.Warn("Broker: %d outbound messages still queued", pending)
+	}
+	if presence, _ := m.owner.Presence(); presence != entity.PresenceInvisible {
+		if err := m.broadcast.announceLeave(); err != nil {
+			utils.LL.Error("Broker: leave %s", err.Error())
+		}
+	}
+	for _, room := range m.owner.Repo.GetRooms() {
+		if room.IsGeneral || room.IsGroup {
+			continue
+		}
+		room.SendLeave()
+	}
+	if m.cancel != nil {
+		m.cancel()
+	}
+	select {
+	case <-m.p2p.done:
+	case <-ctx.Done():
+	}
 }
@@ -1,9 +1,10 @@
 package connection
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"math/big"
 	"net"
 	"time"
 
@@ -15,13 +16,17 @@ type BroadcastChannel struct {
 	addr      *net.UDPAddr
 	frequency time.Duration
 	owner     *entity.Owner
+	realm     *utils.Realm
+	handler   entity.FrameHandler
 }
 
-func NewBroadcastChannel(addr *net.UDPAddr, frequency time.Duration, o *entity.Owner) *BroadcastChannel {
+func NewBroadcastChannel(addr *net.UDPAddr, frequency time.Duration, o *entity.Owner, realm *utils.Realm, handler entity.FrameHandler) *BroadcastChannel {
 	return &BroadcastChannel{
 		addr:      addr,
 		frequency: frequency,
 		owner:     o,
+		realm:     realm,
+		handler:   handler,
 	}
 }
 
@@ -31,7 +36,7 @@ func (d *BroadcastChannel) Start(ctx context.Context) {
 	go d.listenCasting(ctx)
 }
 
-func (d *BroadcastChannel) broadcastMessage(ctx context.Context, conn *net.UDPConn, prefix string, channel chan *entity.ChatMessage) {
+func (d *BroadcastChannel) broadcastMessage(ctx context.Context, conn *net.UDPConn, channel chan *entity.Envelope) {
 	if conn == nil {
 		return
 	}
@@ -39,24 +44,35 @@ func (d *BroadcastChannel) broadcastMessage(ctx context.Context, conn *net.UDPCo
 		select {
 		case <-ctx.Done():
 			return
-		case msg, ok := <-channel:
+		case env, ok := <-channel:
 			if !ok {
 				return
 			}
-			_, err := conn.Write([]byte(fmt.Sprintf("%s|%s|%s|%s",
-				prefix,
-				msg.Time.Format(time.RFC3339),
-				msg.Content,
-				msg.Author,
-			)))
-			if err != nil {
+			env.Sign(d.owner.Identity)
+			if err := d.write(conn, env); err != nil {
 				utils.LL.Error("BroadcastMessage: %s", err.Error())
-				return
+				continue
 			}
 		}
 	}
 }
 
+func (d *BroadcastChannel) write(conn *net.UDPConn, env *entity.Envelope) error {
+	bytes, err := entity.EncodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	bytes, err = d.realm.Seal(bytes)
+	if err != nil {
+		return err
+	}
+	if len(bytes) > bufferSize {
+		return entity.ErrMessageTooLarge
+	}
+	_, err = conn.Write(bytes)
+	return err
+}
+
 func (d *BroadcastChannel) startCasting(ctx context.Context) {
 	conn, err := net.DialUDP("udp", nil, d.addr)
 	if err != nil {
@@ -65,24 +81,41 @@ func (d *BroadcastChannel) startCasting(ctx context.Context) {
 	}
 
 	for _, r := range d.owner.Repo.GetGeneralRooms() {
-		go d.broadcastMessage(ctx, conn, fmt.Sprintf("%s|%s", r.Id, d.owner.Id), r.BroadcastChan)
+		go d.broadcastMessage(ctx, conn, r.BroadcastChan)
 	}
 
 	ticker := time.NewTicker(d.frequency)
+	visible := false
 	for {
 		select {
 		case <-ctx.Done():
 			conn.Close()
 			return
 		case <-ticker.C:
-			msg := &entity.DiscoveryMessage{
-				Id:     d.owner.Id,
-				Name:   d.owner.Name,
-				PubKey: d.owner.DH.PublicKey,
-				Port:   d.owner.Port,
+			presence, status := d.owner.Presence()
+			if presence == entity.PresenceInvisible {
+				if !visible {
+					continue
+				}
+				visible, status = false, ""
+			} else {
+				visible = true
 			}
-			_, err = conn.Write(msg.ToBytes())
+			env, err := entity.NewEnvelope(entity.KindDiscovery, d.owner.Id, &entity.DiscoveryMessage{
+				Id:          d.owner.Id,
+				Name:        d.owner.Name,
+				Keys:        d.owner.PublicKeys(),
+				Port:        d.owner.Port,
+				IdentityKey: d.owner.Identity.PublicKey,
+				Presence:    presence,
+				Status:      status,
+			})
 			if err != nil {
+				utils.LL.Error("BroadcastChannel: Casting %s", err.Error())
+				continue
+			}
+			env.Sign(d.owner.Identity)
+			if err = d.write(conn, env); err != nil {
 				utils.LL.Error("BroadcastChannel: Casting %s", err.Error())
 				return
 			}
@@ -113,48 +146,188 @@ func (d *BroadcastChannel) listenCasting(ctx context.Context) {
 				return
 			}
 
-			err = entity.DiscoveryMessageFromBytes(rawBytes, func(s []string) error {
-				k := new(big.Int)
-				k, ok := k.SetString(s[2], 10)
-				if !ok {
-					return fmt.Errorf("invalid pubkey")
-				}
-				room := &entity.Room{
-					Id:        s[0],
-					Name:      s[1],
-					PubKey:    k,
-					Host:      fmt.Sprintf("%s:%s", addr.IP.String(), s[3]),
-					Messages:  make([]*entity.ChatMessage, 0),
-					IsGeneral: false,
-					WSChan:    make(chan string, 10),
-				}
-				if room.Id != d.owner.Id {
-					if _, roomFound := d.owner.Repo.Get(room.Id); !roomFound {
-						utils.LL.Info("ListenCasting: JOINING [green]%s[white] - [yellow]%s[white]", room.Name, room.Host)
-						d.owner.Repo.Add(room)
-						go room.HandleWS(ctx)
-					}
-				}
-				return nil
-			}, func(s []string) error {
-				if s[1] != d.owner.Id {
-					if t, err := time.Parse(time.RFC3339, s[2]); err == nil {
-						if r, ok := d.owner.Repo.Get(s[0]); ok {
-							utils.LL.Info("ListenCasting: MESSAGE from [green]%s[white]", s[4])
-							r.Messages = append(r.Messages, &entity.ChatMessage{
-								Time:    t,
-								Content: s[3],
-								Author:  s[4],
-							})
-						}
-					}
-				}
-				return nil
-			})
+			rawBytes, err = d.realm.Open(rawBytes)
+			if err != nil {
+				continue
+			}
+			env, err := entity.DecodeEnvelope(rawBytes)
+			if errors.Is(err, entity.ErrLegacyDiscovery) {
+				continue
+			}
+			if err != nil {
+				utils.LL.Error("DiscoveryMessage: %s", err.Error())
+				continue
+			}
+			if env.SenderId == d.owner.Id {
+				continue
+			}
+			switch env.Kind {
+			case entity.KindDiscovery:
+				err = d.handleDiscovery(ctx, env, addr)
+			case entity.KindChat:
+				err = d.handleChat(env)
+			case entity.KindEdit, entity.KindDelete:
+				err = d.handleRevision(env)
+			case entity.KindReaction:
+				err = d.handleReaction(env)
+			case entity.KindLeave:
+				err = d.handleLeave(env)
+			}
 			if err != nil {
 				utils.LL.Error("DiscoveryMessage: %s", err.Error())
-				return
 			}
 		}
 	}
 }
+
+func (d *BroadcastChannel) handleDiscovery(ctx context.Context, env *entity.Envelope, addr *net.UDPAddr) error {
+	msg := &entity.DiscoveryMessage{}
+	if err := env.Decode(msg); err != nil {
+		return err
+	}
+	if msg.Id != env.SenderId || len(msg.Keys) == 0 {
+		return entity.ErrBadMessage
+	}
+	known, roomFound := d.owner.Repo.Get(msg.Id)
+	host := fmt.Sprintf("%s:%s", addr.IP.String(), msg.Port)
+	if err := env.Verify(msg.IdentityKey); err != nil {
+		return err
+	}
+	if skew := time.Since(env.Time); skew > discoveryMaxSkew || skew < -discoveryMaxSkew {
+		return entity.ErrStaleMessage
+	}
+	scheme, pubKey, err := msg.Negotiate()
+	if err != nil {
+		return err
+	}
+	if !roomFound && msg.Presence == entity.PresenceInvisible {
+		return nil
+	}
+	if roomFound {
+		if !bytes.Equal(known.IdentityKey, msg.IdentityKey) {
+			return entity.ErrBadSignature
+		}
+		if known.SetHost(host) {
+			utils.LL.Info("ListenCasting: [green]%s[white] moved to [yellow]%s[white]", known.Name, host)
+		}
+		if known.SetPublicKey(scheme, pubKey) {
+			utils.LL.Info("ListenCasting: [green]%s[white] restarted, resetting session", known.Name)
+		}
+		known.SetPresence(msg.Presence, msg.Status)
+		known.Touch()
+		return nil
+	}
+	room := entity.NewRoom(msg.Id, msg.Name, host, scheme, pubKey, msg.IdentityKey)
+	status, err := d.owner.Trust.Observe(msg.Id, msg.Name, msg.IdentityKey)
+	if err != nil {
+		utils.LL.Error("ListenCasting: Trust %s", err.Error())
+	}
+	room.Trust = status
+	room.SetPresence(msg.Presence, msg.Status)
+	if status == entity.TrustChanged {
+		utils.LL.Warn("ListenCasting: [red]KEY CHANGED[white] for [green]%s[white] - [yellow]%s[white], fingerprint %s does not match the one seen before",
+			room.Name, room.Host, utils.Fingerprint(msg.IdentityKey))
+	}
+	utils.LL.Info("ListenCasting: JOINING [green]%s[white] - [yellow]%s[white]", room.Name, room.Host)
+	room.Bind(d.owner, d.handler)
+	d.owner.Repo.Add(room)
+	go room.HandleWS(ctx)
+	d.owner.PeerJoined(room)
+	return nil
+}
+
+func (d *BroadcastChannel) announceLeave() error {
+	conn, err := net.DialUDP("udp", nil, d.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	env, err := entity.NewEnvelope(entity.KindLeave, d.owner.Id, struct{}{})
+	if err != nil {
+		return err
+	}
+	env.Sign(d.owner.Identity)
+	return d.write(conn, env)
+}
+
+func (d *BroadcastChannel) handleLeave(env *entity.Envelope) error {
+	room, found := d.owner.Repo.Get(env.SenderId)
+	if !found || room.IsGeneral || room.IsGroup {
+		return nil
+	}
+	if err := env.Verify(room.IdentityKey); err != nil {
+		return err
+	}
+	if skew := time.Since(env.Time); skew > discoveryMaxSkew || skew < -discoveryMaxSkew {
+		return entity.ErrStaleMessage
+	}
+	utils.LL.Info("ListenCasting: LEAVING [green]%s[white] - [yellow]%s[white]", room.Name, room.Addr())
+	d.owner.Repo.Drop(room)
+	return nil
+}
+
+func (d *BroadcastChannel) handleChat(env *entity.Envelope) error {
+	msg := &entity.ChatPayload{}
+	if err := env.Decode(msg); err != nil {
+		return err
+	}
+	if r, ok := d.owner.Repo.Get(msg.RoomId); ok && r.IsGeneral {
+		utils.LL.Info("ListenCasting: MESSAGE from [green]%s[white]", msg.Author)
+		m := &entity.ChatMessage{
+			Time:     env.Time,
+			Content:  msg.Content,
+			Author:   msg.Author,
+			ParentId: msg.ParentId,
+		}
+		if sender, found := d.owner.Repo.Get(env.SenderId); found && !env.IsLegacy() && env.Verify(sender.IdentityKey) == nil {
+			m.Id, m.AuthorId = env.MessageId, env.SenderId
+		}
+		r.Append(m)
+	}
+	return nil
+}
+
+func (d *BroadcastChannel) verifiedSender(env *entity.Envelope) (*entity.Room, error) {
+	sender, found := d.owner.Repo.Get(env.SenderId)
+	if !found || sender.IsGeneral || sender.IsGroup {
+		return nil, entity.ErrNotAuthor
+	}
+	if err := env.Verify(sender.IdentityKey); err != nil {
+		return nil, err
+	}
+	if skew := time.Since(env.Time); skew > discoveryMaxSkew || skew < -discoveryMaxSkew {
+		return nil, entity.ErrStaleMessage
+	}
+	return sender, nil
+}
+
+func (d *BroadcastChannel) handleRevision(env *entity.Envelope) error {
+	msg := &entity.EditMessage{}
+	if err := env.Decode(msg); err != nil {
+		return err
+	}
+	r, ok := d.owner.Repo.Get(msg.RoomId)
+	if !ok || !r.IsGeneral {
+		return nil
+	}
+	if _, err := d.verifiedSender(env); err != nil {
+		return err
+	}
+	return r.Revise(msg.MessageId, env.SenderId, msg.Content, env.Kind == entity.KindDelete)
+}
+
+func (d *BroadcastChannel) handleReaction(env *entity.Envelope) error {
+	msg := &entity.ReactionMessage{}
+	if err := env.Decode(msg); err != nil {
+		return err
+	}
+	r, ok := d.owner.Repo.Get(msg.RoomId)
+	if !ok || !r.IsGeneral {
+		return nil
+	}
+	sender, err := d.verifiedSender(env)
+	if err != nil {
+		return err
+	}
+	return r.React(msg.MessageId, entity.Reaction{Emoji: msg.Emoji, UserId: sender.Id, User: sender.Name}, !msg.Removed)
+}
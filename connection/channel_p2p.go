@@ -2,8 +2,8 @@ package connection
 
 import (
 	"context"
+	"errors"
 	"net/http"
-	"strings"
 	"time"
 
 	"chat_tool/entity"
@@ -15,46 +15,35 @@ import (
 type P2PChannel struct {
 	addr  string
 	owner *entity.Owner
+	done  chan struct{}
 }
 
 func NewP2PChannel(addr string, o *entity.Owner) *P2PChannel {
 	return &P2PChannel{
 		owner: o,
 		addr:  addr,
+		done:  make(chan struct{}),
 	}
 }
 
 func (d *P2PChannel) Start(ctx context.Context) {
+	defer close(d.done)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("OK"))
 	})
 	mux.Handle("/ws", websocket.Handler(func(c *websocket.Conn) {
 		utils.LL.Info("WS: Handshake")
-		var msg = make([]byte, bufferSize)
-		var n int
-		var err error
-		for {
-			if n, err = c.Read(msg); err != nil {
-				utils.LL.Error("WS: Read, %s", err.Error())
-				break
-			}
-
-			arr := strings.Split(string(msg[:n]), "|")
-			roomId := arr[0]
-			messageText := arr[1]
-			peer, found := d.owner.Repo.Get(roomId)
-			if !found {
-				continue
-			}
-
-			decryptedMessage, err := utils.DecryptMessage(utils.GetSecret(peer.PubKey, d.owner.DH), messageText)
-			if err != nil {
-				utils.LL.Error("WS: CHAT %s", err.Error())
-				continue
-			}
-			peer.AddMessage(decryptedMessage, peer.Name)
+		peer, session, err := d.owner.AcceptHandshake(c)
+		if err != nil {
+			utils.LL.Error("WS: Handshake %s", err.Error())
+			return
 		}
+		if err := peer.Accept(c, session); err != nil {
+			utils.LL.Info("WS: keeping existing session with [green]%s[white]", peer.Name)
+			return
+		}
+		peer.Serve(c, session)
 		utils.LL.Info("WS: END")
 	}))
 
@@ -76,3 +65,52 @@ func (d *P2PChannel) Start(ctx context.Context) {
 	server.Shutdown(ctxTimeout)
 	utils.LL.Info("P2P: Shutdown")
 }
+
+func (d *P2PChannel) HandleFrame(peer *entity.Room, env *entity.Envelope) {
+	var err error
+	switch env.Kind {
+	case entity.KindPrivate:
+		err = d.handlePrivate(peer, env)
+	case entity.KindGroupKey:
+		err = d.owner.HandleGroupKey(peer, env)
+	case entity.KindGroupLeave:
+		err = d.owner.HandleGroupLeave(peer, env)
+	case entity.KindGroupMessage:
+		err = d.owner.HandleGroupMessage(peer, env)
+	case entity.KindAck:
+		err = d.owner.HandleAck(peer, env)
+	case entity.KindEdit, entity.KindDelete:
+		err = d.owner.HandleRevision(peer, env)
+	case entity.KindReaction:
+		err = d.owner.HandleReaction(peer, env)
+	case entity.KindRead:
+		err = d.owner.HandleRead(peer, env)
+	case entity.KindTyping:
+		err = d.owner.HandleTyping(peer, env)
+	case entity.KindLeave:
+		if err = d.owner.HandleLeave(peer, env); err == nil {
+			utils.LL.Info("WS: [green]%s[white] left", peer.Name)
+		}
+	default:
+		utils.LL.Warn("WS: dropping %s frame from %s", env.Kind, env.SenderId)
+	}
+	var decryptErr *utils.DecryptError
+	if errors.As(err, &decryptErr) {
+		utils.LL.Warn("WS: rejected %s from [green]%s[white], %s", env.Kind, peer.Name, err.Error())
+		return
+	}
+	if err != nil {
+		utils.LL.Error("WS: %s %s", env.Kind, err.Error())
+	}
+}
+
+func (d *P2PChannel) handlePrivate(peer *entity.Room, env *entity.Envelope) error {
+	m, isNew, err := peer.OpenMessage(env, d.owner.Id)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		peer.Receive(m)
+	}
+	return d.owner.SendAck(peer, m.Id)
+}
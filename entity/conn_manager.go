@@ -0,0 +1,320 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"chat_tool/utils"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	dialBackoffBase   = 500 * time.Millisecond
+	heartbeatInterval = 5 * time.Second
+	heartbeatTimeout  = 15 * time.Second
+)
+
+var (
+	ErrBackingOff = errors.New("ErrorBackingOff")
+	ErrHalfOpen   = errors.New("ErrorHalfOpen")
+	ErrDuplicate  = errors.New("ErrorDuplicateSession")
+)
+
+type ConnState int
+
+const (
+	ConnIdle ConnState = iota
+	ConnConnecting
+	ConnConnected
+	ConnBackingOff
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnBackingOff:
+		return "backing-off"
+	}
+	return "idle"
+}
+
+type FrameHandler func(peer *Room, env *Envelope)
+
+type ConnManager struct {
+	mutex     sync.Mutex
+	host      string
+	ownerId   string
+	peerId    string
+	handshake func(conn *websocket.Conn) (*Session, error)
+	dispatch  func(env *Envelope)
+	connected func()
+	state     ConnState
+	conn      *websocket.Conn
+	session   *Session
+	gen       uint64
+	failures  int
+	nextDial  time.Time
+	lastSeen  time.Time
+	lastPing  time.Time
+}
+
+func NewConnManager(host, peerId string) *ConnManager {
+	return &ConnManager{
+		host:   host,
+		peerId: peerId,
+		state:  ConnIdle,
+	}
+}
+
+func (m *ConnManager) bind(ownerId string, handshake func(conn *websocket.Conn) (*Session, error), dispatch func(env *Envelope), connected func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ownerId = ownerId
+	m.handshake = handshake
+	m.dispatch = dispatch
+	m.connected = connected
+}
+
+func (m *ConnManager) LastSeen() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conn == nil {
+		return time.Time{}
+	}
+	return m.lastSeen
+}
+
+func (m *ConnManager) State() ConnState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state
+}
+
+func (m *ConnManager) setState(state ConnState) {
+	if m.state == state {
+		return
+	}
+	m.state = state
+	utils.Events.Publish(utils.Event{Kind: utils.EventRoomUpdated, RoomId: m.peerId})
+}
+
+func (m *ConnManager) Conn() (*websocket.Conn, *Session, uint64, error) {
+	m.mutex.Lock()
+	if m.state == ConnConnected {
+		defer m.mutex.Unlock()
+		return m.conn, m.session, m.gen, nil
+	}
+	if m.state == ConnBackingOff && time.Now().Before(m.nextDial) {
+		m.mutex.Unlock()
+		return nil, nil, m.gen, ErrBackingOff
+	}
+	m.setState(ConnConnecting)
+	host, handshake := m.host, m.handshake
+	m.mutex.Unlock()
+
+	var session *Session
+	conn, err := dial(host)
+	if err == nil && handshake != nil {
+		session, err = handshake(conn)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.state == ConnConnected {
+		if conn != nil {
+			conn.Close()
+		}
+		return m.conn, m.session, m.gen, nil
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		m.backoff()
+		return nil, nil, m.gen, err
+	}
+	m.attach(conn, session)
+	go m.Serve(conn, session)
+	return conn, session, m.gen, nil
+}
+
+func (m *ConnManager) Accept(conn *websocket.Conn, session *Session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conn != nil || m.state == ConnConnecting {
+		if m.ownerId < m.peerId {
+			return ErrDuplicate
+		}
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}
+	m.attach(conn, session)
+	return nil
+}
+
+func (m *ConnManager) attach(conn *websocket.Conn, session *Session) {
+	now := time.Now()
+	m.conn = conn
+	m.session = session
+	m.gen++
+	m.setState(ConnConnected)
+	m.failures = 0
+	m.lastSeen = now
+	m.lastPing = now
+	if m.connected != nil {
+		go m.connected()
+	}
+}
+
+func dial(host string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(fmt.Sprintf("ws://%s/ws", host), fmt.Sprintf("http://%s/", host))
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &dialer
+	return websocket.DialConfig(config)
+}
+
+func sendFrame(conn *websocket.Conn, kind EnvelopeKind, senderId string, payload any) error {
+	env, err := NewEnvelope(kind, senderId, payload)
+	if err != nil {
+		return err
+	}
+	msg, err := EncodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(conn, msg)
+}
+
+func (m *ConnManager) backoff() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+		m.session = nil
+	}
+	m.setState(ConnBackingOff)
+	m.nextDial = time.Now().Add(backoff(m.failures, dialBackoffBase))
+	m.failures++
+}
+
+func (m *ConnManager) Fail(conn *websocket.Conn, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if conn != nil && conn != m.conn {
+		conn.Close()
+		return
+	}
+	utils.LL.Warn("Room-Conn: %s %s, reconnecting", m.host, err.Error())
+	m.backoff()
+}
+
+func (m *ConnManager) Heartbeat() {
+	m.mutex.Lock()
+	conn, state, ownerId := m.conn, m.state, m.ownerId
+	idle, sincePing := time.Since(m.lastSeen), time.Since(m.lastPing)
+	m.mutex.Unlock()
+	if state != ConnConnected {
+		return
+	}
+	if idle > heartbeatTimeout {
+		m.Fail(conn, ErrHalfOpen)
+		return
+	}
+	if sincePing < heartbeatInterval {
+		return
+	}
+	m.mutex.Lock()
+	m.lastPing = time.Now()
+	m.mutex.Unlock()
+	if err := sendFrame(conn, KindPing, ownerId, struct{}{}); err != nil {
+		m.Fail(conn, err)
+	}
+}
+
+func (m *ConnManager) Send(build func(ownerId string, session *Session) (*Envelope, error)) error {
+	m.mutex.Lock()
+	conn, session, ownerId := m.conn, m.session, m.ownerId
+	m.mutex.Unlock()
+	if conn == nil {
+		return ErrDisconnected
+	}
+	env, err := build(ownerId, session)
+	if err != nil {
+		return err
+	}
+	msg, err := EncodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(conn, msg)
+}
+
+func (m *ConnManager) Serve(conn *websocket.Conn, session *Session) {
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			m.Fail(conn, err)
+			return
+		}
+		m.mutex.Lock()
+		m.lastSeen = time.Now()
+		ownerId, peerId, dispatch := m.ownerId, m.peerId, m.dispatch
+		m.mutex.Unlock()
+
+		env, err := DecodeEnvelope(msg)
+		if err != nil {
+			utils.LL.Error("Room-Conn: Envelope %s", err.Error())
+			continue
+		}
+		env.SenderId = peerId
+		env.session = session
+		switch env.Kind {
+		case KindPing:
+			if err := sendFrame(conn, KindPong, ownerId, struct{}{}); err != nil {
+				m.Fail(conn, err)
+				return
+			}
+		case KindPong, KindHello, KindChallenge, KindProof:
+		default:
+			if dispatch != nil {
+				dispatch(env)
+			}
+		}
+	}
+}
+
+func (m *ConnManager) SetHost(host string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.host == host {
+		return
+	}
+	m.host = host
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+		m.session = nil
+	}
+	m.failures = 0
+	m.nextDial = time.Time{}
+	m.setState(ConnIdle)
+}
+
+func (m *ConnManager) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+		m.session = nil
+	}
+	m.setState(ConnIdle)
+}
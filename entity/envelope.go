@@ -0,0 +1,193 @@
+package entity
+
+import (
+	b "bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"chat_tool/utils"
+
+	"github.com/google/uuid"
+)
+
+const (
+	EnvelopeVersion = 1
+	legacyVersion   = 0
+	legacyDiscovery = "P2P|"
+)
+
+type EnvelopeKind string
+
+const (
+	KindDiscovery    EnvelopeKind = "discovery"
+	KindChat         EnvelopeKind = "chat"
+	KindPrivate      EnvelopeKind = "private"
+	KindGroupKey     EnvelopeKind = "group_key"
+	KindGroupLeave   EnvelopeKind = "group_leave"
+	KindGroupMessage EnvelopeKind = "group_message"
+	KindAck          EnvelopeKind = "ack"
+	KindHello        EnvelopeKind = "hello"
+	KindChallenge    EnvelopeKind = "challenge"
+	KindProof        EnvelopeKind = "proof"
+	KindPing         EnvelopeKind = "ping"
+	KindPong         EnvelopeKind = "pong"
+	KindLeave        EnvelopeKind = "leave"
+	KindTyping       EnvelopeKind = "typing"
+	KindRead         EnvelopeKind = "read"
+	KindEdit         EnvelopeKind = "edit"
+	KindDelete       EnvelopeKind = "delete"
+	KindReaction     EnvelopeKind = "reaction"
+)
+
+type Envelope struct {
+	Version   int             `json:"v"`
+	Kind      EnvelopeKind    `json:"k"`
+	SenderId  string          `json:"sid"`
+	MessageId string          `json:"mid"`
+	Time      time.Time       `json:"ts"`
+	Payload   json.RawMessage `json:"p"`
+	Signature []byte          `json:"sig,omitempty"`
+	session   *Session
+}
+
+type ChatPayload struct {
+	RoomId   string `json:"room_id,omitempty"`
+	Content  string `json:"content"`
+	Author   string `json:"author,omitempty"`
+	ParentId string `json:"parent_id,omitempty"`
+}
+
+func sealedChat(m *ChatMessage) ([]byte, error) {
+	return json.Marshal(&ChatPayload{
+		Content:  m.Content,
+		ParentId: m.ParentId,
+	})
+}
+
+func openedChat(plainText []byte) (*ChatPayload, error) {
+	payload := &ChatPayload{}
+	if err := json.Unmarshal(plainText, payload); err != nil {
+		return nil, ErrBadMessage
+	}
+	return payload, nil
+}
+
+type PrivatePayload struct {
+	Counter uint64 `json:"ctr"`
+	Cipher  []byte `json:"cipher"`
+}
+
+func NewEnvelope(kind EnvelopeKind, senderId string, payload any) (*Envelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Version:   EnvelopeVersion,
+		Kind:      kind,
+		SenderId:  senderId,
+		MessageId: uuid.NewString(),
+		Time:      time.Now().UTC(),
+		Payload:   raw,
+	}, nil
+}
+
+func (e *Envelope) Decode(payload any) error {
+	if err := json.Unmarshal(e.Payload, payload); err != nil {
+		return ErrBadMessage
+	}
+	return nil
+}
+
+func (e *Envelope) SigningBytes() []byte {
+	buf := make([]byte, 0, 64+len(e.SenderId)+len(e.MessageId)+len(e.Payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(e.Version))
+	for _, field := range []string{string(e.Kind), e.SenderId, e.MessageId} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.Time.UnixNano()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.Payload)))
+	return append(buf, e.Payload...)
+}
+
+func (e *Envelope) Sign(identity *utils.Identity) {
+	e.Signature = identity.Sign(e.SigningBytes())
+}
+
+func (e *Envelope) Verify(identityKey []byte) error {
+	if len(e.Signature) == 0 {
+		return ErrUnsignedMessage
+	}
+	if utils.IdentityId(identityKey) != e.SenderId {
+		return ErrBadSignature
+	}
+	if !utils.VerifySignature(identityKey, e.SigningBytes(), e.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func (e *Envelope) IsLegacy() bool {
+	return e.Version == legacyVersion
+}
+
+func EncodeEnvelope(e *Envelope) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func DecodeEnvelope(bytes []byte) (*Envelope, error) {
+	bytes = b.Trim(bytes, nullByte)
+	if len(bytes) == 0 {
+		return nil, ErrBadMessage
+	}
+	if bytes[0] != '{' {
+		return decodeLegacyEnvelope(bytes)
+	}
+	e := &Envelope{}
+	if err := json.Unmarshal(bytes, e); err != nil {
+		return nil, ErrBadMessage
+	}
+	if e.Version < EnvelopeVersion || e.Kind == "" || e.SenderId == "" {
+		return nil, ErrBadMessage
+	}
+	if id, err := uuid.Parse(e.MessageId); err != nil || id.String() != e.MessageId {
+		return nil, ErrBadMessage
+	}
+	if e.Version > EnvelopeVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	return e, nil
+}
+
+// roomId|senderId|time|content|author, General chat from pre-envelope nodes
+func decodeLegacyEnvelope(bytes []byte) (*Envelope, error) {
+	if b.HasPrefix(bytes, []byte(legacyDiscovery)) {
+		return nil, ErrLegacyDiscovery
+	}
+	arr := strings.Split(string(bytes), "|")
+	if len(arr) < 5 {
+		return nil, ErrBadMessage
+	}
+	t, err := time.Parse(time.RFC3339, arr[2])
+	if err != nil {
+		return nil, ErrBadMessage
+	}
+	return legacyEnvelope(KindChat, arr[1], t, &ChatPayload{
+		RoomId:  arr[0],
+		Content: strings.Join(arr[3:len(arr)-1], "|"),
+		Author:  arr[len(arr)-1],
+	})
+}
+
+func legacyEnvelope(kind EnvelopeKind, senderId string, t time.Time, payload any) (*Envelope, error) {
+	e, err := NewEnvelope(kind, senderId, payload)
+	if err != nil {
+		return nil, err
+	}
+	e.Version = legacyVersion
+	e.Time = t
+	return e, nil
+}
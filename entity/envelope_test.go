@@ -0,0 +1,48 @@
+package entity
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeLegacyFrames(t *testing.T) {
+	_, err := DecodeEnvelope([]byte("P2P|id|name|key|25042"))
+	if !errors.Is(err, ErrLegacyDiscovery) {
+		t.Fatalf("legacy beacon: %v", err)
+	}
+	env, err := DecodeEnvelope([]byte("general|sender|2023-06-01T10:00:00Z|a|b|author"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := &ChatPayload{}
+	if err := env.Decode(payload); err != nil {
+		t.Fatal(err)
+	}
+	if !env.IsLegacy() || payload.Content != "a|b" || payload.Author != "author" {
+		t.Fatalf("legacy chat: %+v", payload)
+	}
+}
+
+func TestDecodeRejectsNonUUIDMessageIds(t *testing.T) {
+	env, err := NewEnvelope(KindChat, "sender", &ChatPayload{Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := env.MessageId
+	for id, want := range map[string]bool{
+		valid:               true,
+		`x"][red]["y`:       false,
+		"":                  false,
+		"{" + valid + "}":   false,
+		"urn:uuid:" + valid: false,
+	} {
+		env.MessageId = id
+		raw, err := EncodeEnvelope(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeEnvelope(raw); (err == nil) != want {
+			t.Fatalf("id %q: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package entity
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"chat_tool/storage"
+	"chat_tool/utils"
+
+	"github.com/google/uuid"
+)
+
+const (
+	groupsRecord = "groups.json"
+	groupKeySize = 32
+)
+
+var (
+	ErrNotMember  = errors.New("ErrorNotMember")
+	ErrNotAdmin   = errors.New("ErrorNotAdmin")
+	ErrStaleEpoch = errors.New("ErrorStaleEpoch")
+)
+
+type GroupKeyMessage struct {
+	GroupId string   `json:"group_id"`
+	Name    string   `json:"name"`
+	Admin   string   `json:"admin"`
+	Members []string `json:"members"`
+	Epoch   uint64   `json:"epoch"`
+	Key     []byte   `json:"key"`
+}
+
+type GroupLeaveMessage struct {
+	GroupId  string `json:"group_id"`
+	MemberId string `json:"member_id"`
+}
+
+type GroupPayload struct {
+	GroupId string `json:"group_id"`
+	Epoch   uint64 `json:"epoch"`
+	Counter uint64 `json:"ctr"`
+	Cipher  []byte `json:"cipher"`
+}
+
+func newGroupKey() ([]byte, error) {
+	key := make([]byte, groupKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newGroupRoom(m *GroupKeyMessage) *Room {
+	return &Room{
+		Id:          m.GroupId,
+		Name:        m.Name,
+		Messages:    NewMessageStore(m.GroupId),
+		IsGroup:     true,
+		Admin:       m.Admin,
+		Members:     m.Members,
+		Epoch:       m.Epoch,
+		groupKey:    m.Key,
+		groupReplay: make(map[string]*utils.ReplayWindow),
+		seen:        utils.NewRecentSet(seenSize),
+		sendCounter: uint64(time.Now().UnixNano()),
+	}
+}
+
+func (r *Room) IsMember(id string) bool {
+	for _, member := range r.Members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Room) groupKeyMessage() *GroupKeyMessage {
+	return &GroupKeyMessage{
+		GroupId: r.Id,
+		Name:    r.Name,
+		Admin:   r.Admin,
+		Members: r.Members,
+		Epoch:   r.Epoch,
+		Key:     r.groupKey,
+	}
+}
+
+func withoutMember(members []string, id string) []string {
+	result := make([]string, 0, len(members))
+	for _, member := range members {
+		if member != id {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+func nextAdmin(members []string) string {
+	if len(members) == 0 {
+		return ""
+	}
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	return sorted[0]
+}
+
+func (o *Owner) loadGroups() error {
+	data, err := o.store.Get(groupsRecord)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	groups := make([]*GroupKeyMessage, 0)
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		o.Repo.Add(newGroupRoom(g))
+	}
+	return nil
+}
+
+func (o *Owner) saveGroups() {
+	groups := make([]*GroupKeyMessage, 0)
+	for _, room := range o.Repo.GetRooms() {
+		if room.IsGroup {
+			groups = append(groups, room.groupKeyMessage())
+		}
+	}
+	data, err := json.Marshal(groups)
+	if err == nil {
+		err = o.store.Put(groupsRecord, data)
+	}
+	if err != nil {
+		utils.LL.Error("Group: save %s", err.Error())
+	}
+}
+
+func (o *Owner) sendSealed(peer *Room, kind EnvelopeKind, v any) error {
+	plainText, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	messageId := uuid.NewString()
+	return peer.enqueue(&Outbound{
+		MessageId: messageId,
+		needsAck:  kind != KindAck && kind != KindTyping,
+		build: func(session *Session) (*Envelope, error) {
+			return peer.sealEnvelope(session, kind, o.Id, messageId, plainText)
+		},
+	})
+}
+
+func (o *Owner) openSealed(peer *Room, env *Envelope, v any) (bool, error) {
+	plainText, err := peer.open(env, o.Id)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(plainText, v); err != nil {
+		return false, ErrBadMessage
+	}
+	return peer.seen.Add(env.MessageId), nil
+}
+
+func (o *Owner) distributeGroupKey(g *Room) {
+	o.groupMutex.Lock()
+	m := g.groupKeyMessage()
+	o.groupMutex.Unlock()
+	for _, member := range m.Members {
+		if member == o.Id {
+			continue
+		}
+		if peer, found := o.Repo.Get(member); found {
+			o.sendGroupKey(peer, m)
+		}
+	}
+}
+
+func (o *Owner) CreateGroup(name string, memberIds []string) (*Room, error) {
+	key, err := newGroupKey()
+	if err != nil {
+		return nil, err
+	}
+	g := newGroupRoom(&GroupKeyMessage{
+		GroupId: uuid.NewString(),
+		Name:    name,
+		Admin:   o.Id,
+		Members: append([]string{o.Id}, memberIds...),
+		Epoch:   1,
+		Key:     key,
+	})
+	o.Repo.Add(g)
+	o.saveGroups()
+	o.distributeGroupKey(g)
+	return g, nil
+}
+
+func (o *Owner) rotateGroupKey(g *Room) error {
+	key, err := newGroupKey()
+	if err != nil {
+		return err
+	}
+	o.groupMutex.Lock()
+	g.groupKey = key
+	g.Epoch++
+	o.groupMutex.Unlock()
+	o.saveGroups()
+	o.distributeGroupKey(g)
+	return nil
+}
+
+func (o *Owner) RemoveMember(g *Room, memberId string) error {
+	o.groupMutex.Lock()
+	if g.Admin != o.Id {
+		o.groupMutex.Unlock()
+		return ErrNotAdmin
+	}
+	if !g.IsMember(memberId) || memberId == o.Id {
+		o.groupMutex.Unlock()
+		return ErrNotMember
+	}
+	members := withoutMember(g.Members, o.Id)
+	g.setInfo(g.Name, withoutMember(g.Members, memberId))
+	o.groupMutex.Unlock()
+	g.changed()
+	for _, member := range members {
+		if peer, found := o.Repo.Get(member); found {
+			if err := o.sendSealed(peer, KindGroupLeave, &GroupLeaveMessage{GroupId: g.Id, MemberId: memberId}); err != nil {
+				utils.LL.Error("Group: remove %s %s", peer.Name, err.Error())
+			}
+		}
+	}
+	return o.rotateGroupKey(g)
+}
+
+func (o *Owner) LeaveGroup(g *Room) {
+	o.groupMutex.Lock()
+	members := withoutMember(g.Members, o.Id)
+	o.groupMutex.Unlock()
+	for _, member := range members {
+		if peer, found := o.Repo.Get(member); found {
+			if err := o.sendSealed(peer, KindGroupLeave, &GroupLeaveMessage{GroupId: g.Id, MemberId: o.Id}); err != nil {
+				utils.LL.Error("Group: leave %s %s", peer.Name, err.Error())
+			}
+		}
+	}
+	o.Repo.Delete(g.Id)
+	o.saveGroups()
+}
+
+func (o *Owner) SendGroupMessage(g *Room, m *ChatMessage) error {
+	o.groupMutex.Lock()
+	key, epoch, members := g.groupKey, g.Epoch, g.Members
+	o.groupMutex.Unlock()
+	peers := make([]*Room, 0, len(members))
+	for _, member := range members {
+		if member == o.Id {
+			continue
+		}
+		if peer, found := o.Repo.Get(member); found {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		g.Messages.SetState(m.Id, DeliveryFailed)
+		return nil
+	}
+	plainText, err := sealedChat(m)
+	if err != nil {
+		return err
+	}
+	g.Messages.SetState(m.Id, DeliveryPending)
+	onState := groupDelivery(func(state DeliveryState) {
+		g.Messages.SetState(m.Id, state)
+	}, len(peers))
+	for _, peer := range peers {
+		err := peer.enqueue(&Outbound{
+			MessageId: m.Id,
+			needsAck:  true,
+			onState:   onState,
+			build: func(*Session) (*Envelope, error) {
+				counter := atomic.AddUint64(&g.sendCounter, 1)
+				cipherText, err := utils.SealMessage(key, string(plainText), utils.AssociatedData(string(KindGroupMessage), g.Id, o.Id, m.Id, counter))
+				if err != nil {
+					return nil, err
+				}
+				env, err := NewEnvelope(KindGroupMessage, o.Id, &GroupPayload{
+					GroupId: g.Id,
+					Epoch:   epoch,
+					Counter: counter,
+					Cipher:  cipherText,
+				})
+				if err != nil {
+					return nil, err
+				}
+				env.MessageId = m.Id
+				env.Sign(o.Identity)
+				return env, nil
+			},
+		})
+		if err != nil {
+			onState(DeliveryFailed)
+		}
+	}
+	return nil
+}
+
+func (o *Owner) HandleGroupKey(peer *Room, env *Envelope) error {
+	m := &GroupKeyMessage{}
+	isNew, err := o.openSealed(peer, env, m)
+	if err != nil {
+		return err
+	}
+	if err := o.SendAck(peer, env.MessageId); err != nil || !isNew {
+		return err
+	}
+	if len(m.Key) != groupKeySize || m.Admin != peer.Id {
+		return ErrNotAdmin
+	}
+	found := false
+	for _, member := range m.Members {
+		found = found || member == o.Id
+	}
+	if !found {
+		return ErrNotMember
+	}
+	g, exists := o.Repo.Get(m.GroupId)
+	if !exists {
+		utils.LL.Info("Group: JOINING [green]%s[white] invited by [green]%s[white]", m.Name, peer.Name)
+		o.Repo.Add(newGroupRoom(m))
+		o.saveGroups()
+		return nil
+	}
+	o.groupMutex.Lock()
+	if !g.IsGroup || g.Admin != peer.Id {
+		o.groupMutex.Unlock()
+		return ErrNotAdmin
+	}
+	if m.Epoch == g.Epoch {
+		o.groupMutex.Unlock()
+		return nil
+	}
+	if m.Epoch < g.Epoch {
+		o.groupMutex.Unlock()
+		return ErrStaleEpoch
+	}
+	g.setInfo(m.Name, m.Members)
+	g.Epoch, g.groupKey = m.Epoch, m.Key
+	o.groupMutex.Unlock()
+	g.changed()
+	o.saveGroups()
+	return nil
+}
+
+func (o *Owner) HandleGroupLeave(peer *Room, env *Envelope) error {
+	m := &GroupLeaveMessage{}
+	isNew, err := o.openSealed(peer, env, m)
+	if err != nil {
+		return err
+	}
+	if err := o.SendAck(peer, env.MessageId); err != nil || !isNew {
+		return err
+	}
+	g, found := o.Repo.Get(m.GroupId)
+	if !found || !g.IsGroup {
+		return nil
+	}
+	o.groupMutex.Lock()
+	if m.MemberId != peer.Id && g.Admin != peer.Id {
+		o.groupMutex.Unlock()
+		return ErrNotAdmin
+	}
+	if m.MemberId == o.Id {
+		o.groupMutex.Unlock()
+		utils.LL.Info("Group: REMOVED from [green]%s[white]", g.Name)
+		o.Repo.Delete(g.Id)
+		o.saveGroups()
+		return nil
+	}
+	g.setInfo(g.Name, withoutMember(g.Members, m.MemberId))
+	if g.Admin == m.MemberId {
+		g.Admin = nextAdmin(g.Members)
+	}
+	isAdmin := g.Admin == o.Id
+	o.groupMutex.Unlock()
+	g.changed()
+	if m.MemberId == peer.Id {
+		utils.LL.Info("Group: [green]%s[white] left [green]%s[white]", peer.Name, g.Name)
+	} else {
+		utils.LL.Info("Group: [green]%s[white] removed %s from [green]%s[white]", peer.Name, m.MemberId, g.Name)
+	}
+	if isAdmin {
+		return o.rotateGroupKey(g)
+	}
+	o.saveGroups()
+	return nil
+}
+
+func (o *Owner) HandleGroupMessage(peer *Room, env *Envelope) error {
+	if err := env.Verify(peer.IdentityKey); err != nil {
+		return err
+	}
+	payload := &GroupPayload{}
+	if err := env.Decode(payload); err != nil {
+		return err
+	}
+	g, found := o.Repo.Get(payload.GroupId)
+	if !found || !g.IsGroup {
+		return ErrNotMember
+	}
+	o.groupMutex.Lock()
+	if !g.IsMember(peer.Id) {
+		o.groupMutex.Unlock()
+		return ErrNotMember
+	}
+	if payload.Epoch != g.Epoch {
+		resend := payload.Epoch < g.Epoch && g.Admin == o.Id
+		m := g.groupKeyMessage()
+		o.groupMutex.Unlock()
+		if resend {
+			o.sendGroupKey(peer, m)
+		}
+		return ErrStaleEpoch
+	}
+	key := g.groupKey
+	replay, found := g.groupReplay[peer.Id]
+	if !found {
+		replay = utils.NewReplayWindow()
+		g.groupReplay[peer.Id] = replay
+	}
+	o.groupMutex.Unlock()
+	if err := replay.Check(payload.Counter); err != nil {
+		return err
+	}
+	message, err := utils.OpenMessage(key, payload.Cipher, utils.AssociatedData(string(KindGroupMessage), g.Id, peer.Id, env.MessageId, payload.Counter))
+	if err != nil {
+		return err
+	}
+	if err := replay.Accept(payload.Counter); err != nil {
+		return err
+	}
+	chat, err := openedChat([]byte(message))
+	if err != nil {
+		return err
+	}
+	if g.seen.Add(peer.Id + "/" + env.MessageId) {
+		g.Append(&ChatMessage{
+			Id:       env.MessageId,
+			Time:     env.Time,
+			Content:  chat.Content,
+			Author:   peer.Name,
+			AuthorId: peer.Id,
+			ParentId: chat.ParentId,
+		})
+	}
+	return o.SendAck(peer, env.MessageId)
+}
+
+func (o *Owner) PeerJoined(peer *Room) {
+	for _, g := range o.Repo.GetRooms() {
+		if !g.IsGroup {
+			continue
+		}
+		o.groupMutex.Lock()
+		resend := g.Admin == o.Id && g.IsMember(peer.Id)
+		m := g.groupKeyMessage()
+		o.groupMutex.Unlock()
+		if resend {
+			o.sendGroupKey(peer, m)
+		}
+	}
+}
+
+func (o *Owner) sendGroupKey(peer *Room, m *GroupKeyMessage) {
+	if err := o.sendSealed(peer, KindGroupKey, m); err != nil {
+		utils.LL.Error("Group: key to %s %s", peer.Name, err.Error())
+	}
+}
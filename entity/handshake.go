@@ -0,0 +1,175 @@
+package entity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"chat_tool/utils"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	handshakeLabel   = "chat_tool handshake v1"
+	handshakeTimeout = 5 * time.Second
+	nonceSize        = 32
+	roleClient       = "client"
+	roleServer       = "server"
+	roleSession      = "session"
+)
+
+var (
+	ErrHandshake = errors.New("ErrorHandshake")
+)
+
+type HelloMessage struct {
+	Nonce     []byte `json:"nonce"`
+	Ephemeral []byte `json:"eph"`
+}
+
+type ChallengeMessage struct {
+	Nonce     []byte `json:"nonce"`
+	Ephemeral []byte `json:"eph"`
+	Signature []byte `json:"sig"`
+}
+
+type ProofMessage struct {
+	Signature []byte `json:"sig"`
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func handshakeTranscript(role, scheme, clientId, serverId string, clientNonce, serverNonce, clientKey, serverKey, clientEph, serverEph []byte) []byte {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(handshakeLabel), []byte(role), []byte(scheme), []byte(clientId), []byte(serverId), clientNonce, serverNonce, clientKey, serverKey, clientEph, serverEph} {
+		binary.Write(h, binary.BigEndian, uint32(len(field)))
+		h.Write(field)
+	}
+	return h.Sum(nil)
+}
+
+func receiveFrame(conn *websocket.Conn, kind EnvelopeKind, payload any) (*Envelope, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	var msg []byte
+	if err := websocket.Message.Receive(conn, &msg); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	env, err := DecodeEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+	if env.Kind != kind {
+		return nil, ErrHandshake
+	}
+	if err := env.Decode(payload); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (o *Owner) dialHandshake(peer *Room, conn *websocket.Conn) (*Session, error) {
+	keys, err := peer.peerKeys(o)
+	if err != nil {
+		return nil, err
+	}
+	clientNonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	eph, err := utils.NewKeyAgreement(keys.scheme)
+	if err != nil {
+		return nil, err
+	}
+	if err := sendFrame(conn, KindHello, o.Id, &HelloMessage{Nonce: clientNonce, Ephemeral: eph.Public()}); err != nil {
+		return nil, err
+	}
+	challenge := &ChallengeMessage{}
+	if _, err := receiveFrame(conn, KindChallenge, challenge); err != nil {
+		return nil, err
+	}
+	if len(challenge.Nonce) != nonceSize {
+		return nil, ErrHandshake
+	}
+	ephemeralSecret, err := eph.SharedSecret(challenge.Ephemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	transcript := func(role string) []byte {
+		return handshakeTranscript(role, keys.scheme, o.Id, peer.Id, clientNonce, challenge.Nonce, keys.local, keys.remote, eph.Public(), challenge.Ephemeral)
+	}
+	if peer.Id != utils.IdentityId(peer.IdentityKey) || !utils.VerifySignature(peer.IdentityKey, transcript(roleServer), challenge.Signature) {
+		return nil, ErrHandshake
+	}
+	if err := sendFrame(conn, KindProof, o.Id, &ProofMessage{Signature: o.Identity.Sign(transcript(roleClient))}); err != nil {
+		return nil, err
+	}
+	return newSession(keys, ephemeralSecret, transcript(roleSession))
+}
+
+func (o *Owner) AcceptHandshake(conn *websocket.Conn) (*Room, *Session, error) {
+	hello := &HelloMessage{}
+	env, err := receiveFrame(conn, KindHello, hello)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hello.Nonce) != nonceSize {
+		return nil, nil, ErrHandshake
+	}
+	peer, found := o.Repo.Get(env.SenderId)
+	if !found || peer.IsGeneral || peer.IsGroup {
+		return nil, nil, ErrNotMember
+	}
+	keys, err := peer.peerKeys(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	eph, err := utils.NewKeyAgreement(keys.scheme)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralSecret, err := eph.SharedSecret(hello.Ephemeral)
+	if err != nil {
+		return nil, nil, ErrHandshake
+	}
+	serverNonce, err := newNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	transcript := func(role string) []byte {
+		return handshakeTranscript(role, keys.scheme, peer.Id, o.Id, hello.Nonce, serverNonce, keys.remote, keys.local, hello.Ephemeral, eph.Public())
+	}
+	if err := sendFrame(conn, KindChallenge, o.Id, &ChallengeMessage{
+		Nonce:     serverNonce,
+		Ephemeral: eph.Public(),
+		Signature: o.Identity.Sign(transcript(roleServer)),
+	}); err != nil {
+		return nil, nil, err
+	}
+	proof := &ProofMessage{}
+	if _, err := receiveFrame(conn, KindProof, proof); err != nil {
+		return nil, nil, err
+	}
+	if peer.Id != utils.IdentityId(peer.IdentityKey) || !utils.VerifySignature(peer.IdentityKey, transcript(roleClient), proof.Signature) {
+		return nil, nil, ErrHandshake
+	}
+	session, err := newSession(keys, ephemeralSecret, transcript(roleSession))
+	if err != nil {
+		return nil, nil, err
+	}
+	return peer, session, nil
+}
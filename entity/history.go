@@ -0,0 +1,90 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"chat_tool/storage"
+)
+
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+type History struct {
+	mutex     sync.Mutex
+	store     *storage.Store
+	retention Retention
+}
+
+func NewHistory(store *storage.Store, retention Retention) *History {
+	return &History{
+		store:     store,
+		retention: retention,
+	}
+}
+
+func historyRecord(roomId string) string {
+	return fmt.Sprintf("history/%s.log", roomId)
+}
+
+func (h *History) Append(roomId string, m *ChatMessage) error {
+	record, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.store.Append(historyRecord(roomId), record)
+}
+
+func (h *History) Load(roomId string) ([]*ChatMessage, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	records, err := h.store.ReadRecords(historyRecord(roomId))
+	if errors.Is(err, storage.ErrNotFound) {
+		return make([]*ChatMessage, 0), nil
+	}
+	corrupted := errors.Is(err, storage.ErrCorrupted)
+	if err != nil && !corrupted {
+		return nil, err
+	}
+	messages := make([]*ChatMessage, 0, len(records))
+	kept := make([][]byte, 0, len(records))
+	positions := make(map[string]int, len(records))
+	for _, record := range records {
+		m := &ChatMessage{}
+		if err := json.Unmarshal(record, m); err != nil {
+			continue
+		}
+		if h.retention.MaxAge > 0 && time.Since(m.Time) > h.retention.MaxAge {
+			continue
+		}
+		if i, found := positions[m.Id]; found {
+			messages[i], kept[i] = m, record
+			continue
+		}
+		if m.Id != "" {
+			positions[m.Id] = len(messages)
+		}
+		messages = append(messages, m)
+		kept = append(kept, record)
+	}
+	if h.retention.MaxCount > 0 && len(messages) > h.retention.MaxCount {
+		messages = messages[len(messages)-h.retention.MaxCount:]
+		kept = kept[len(kept)-h.retention.MaxCount:]
+	}
+	if corrupted {
+		return messages, err
+	}
+	if len(kept) != len(records) {
+		if err := h.store.PutRecords(historyRecord(roomId), kept); err != nil {
+			return messages, err
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"errors"
+
+	"chat_tool/storage"
+	"chat_tool/utils"
+)
+
+const identityRecord = "identity.key"
+
+func LoadIdentity(store *storage.Store) (*utils.Identity, error) {
+	seed, err := store.Get(identityRecord)
+	if err == nil {
+		return utils.IdentityFromSeed(seed)
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	identity, err := utils.NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(identityRecord, identity.Seed()); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
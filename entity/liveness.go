@@ -0,0 +1,132 @@
+package entity
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"chat_tool/utils"
+
+	"github.com/google/uuid"
+)
+
+type Liveness struct {
+	Interval     time.Duration
+	SuspectAfter time.Duration
+	DeadAfter    time.Duration
+	ProbeTimeout time.Duration
+}
+
+func (r *Room) Touch() {
+	atomic.StoreInt64(&r.lastSeen, time.Now().UnixNano())
+}
+
+func (r *Room) LastSeen() time.Time {
+	lastSeen := time.Unix(0, atomic.LoadInt64(&r.lastSeen))
+	if r.conn != nil {
+		if connSeen := r.conn.LastSeen(); connSeen.After(lastSeen) {
+			return connSeen
+		}
+	}
+	return lastSeen
+}
+
+func (r *Room) probe(ctx context.Context, timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&r.probing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&r.probing, 0)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+r.Addr(), nil)
+		if err != nil {
+			utils.LL.Error("Liveness: NewRequest %s", err.Error())
+			return
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			utils.LL.Warn("Liveness: [green]%s[white] not answering, %s", r.Name, err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			r.Touch()
+		}
+	}()
+}
+
+func (r *Room) SendLeave() error {
+	if r.conn == nil {
+		return ErrDisconnected
+	}
+	messageId := uuid.NewString()
+	return r.conn.Send(func(ownerId string, session *Session) (*Envelope, error) {
+		return r.sealEnvelope(session, KindLeave, ownerId, messageId, []byte("{}"))
+	})
+}
+
+func (o *Owner) HandleLeave(peer *Room, env *Envelope) error {
+	if _, err := o.openSealed(peer, env, &struct{}{}); err != nil {
+		return err
+	}
+	o.Repo.Drop(peer)
+	return nil
+}
+
+func (r *RoomRepository) Drop(room *Room) {
+	room.Close()
+	r.Delete(room.Id)
+}
+
+func (r *RoomRepository) Pending() int {
+	pending := 0
+	for _, room := range r.GetRooms() {
+		if room.outbox != nil {
+			pending += room.outbox.Len() + len(room.WSChan)
+		}
+	}
+	return pending
+}
+
+func (r *RoomRepository) Drain(ctx context.Context) int {
+	ticker := time.NewTicker(retryTick)
+	defer ticker.Stop()
+	for {
+		pending := r.Pending()
+		if pending == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *RoomRepository) Watch(ctx context.Context, l Liveness) {
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, room := range r.GetRooms() {
+			if room.IsGeneral || room.IsGroup {
+				continue
+			}
+			idle := time.Since(room.LastSeen())
+			switch {
+			case idle > l.DeadAfter:
+				utils.LL.Info("Liveness: [green]%s[white] is gone, last seen %s ago", room.Name, idle.Round(time.Second))
+				r.Drop(room)
+			case idle > l.SuspectAfter:
+				room.probe(ctx, l.ProbeTimeout)
+			}
+		}
+	}
+}
@@ -1,49 +1,65 @@
 package entity
 
 import (
-	b "bytes"
 	"errors"
-	"fmt"
-	"math/big"
-	"strings"
 	"time"
+
+	"chat_tool/utils"
 )
 
 const (
-	nullByte = "\x00"
+	nullByte          = "\x00"
+	MaxBroadcastSize  = 8192
+	broadcastOverhead = 256
 )
 
 var (
-	ErrBadMessage = errors.New("ErrorBadMessage")
+	ErrBadMessage         = errors.New("ErrorBadMessage")
+	ErrUnsupportedVersion = errors.New("ErrorUnsupportedVersion")
+	ErrMessageTooLarge    = errors.New("ErrorMessageTooLarge")
+	ErrBroadcastBusy      = errors.New("ErrorBroadcastBusy")
+	ErrLegacyDiscovery    = errors.New("ErrorLegacyDiscovery")
+	ErrUnsignedMessage    = errors.New("ErrorUnsignedMessage")
+	ErrBadSignature       = errors.New("ErrorBadSignature")
+	ErrStaleMessage       = errors.New("ErrorStaleMessage")
+	ErrNoCommonScheme     = errors.New("ErrorNoCommonKeyScheme")
 )
 
 type ChatMessage struct {
-	Time    time.Time
-	Content string
-	Author  string
+	Id        string        `json:"id"`
+	Time      time.Time     `json:"time"`
+	Content   string        `json:"content"`
+	Author    string        `json:"author"`
+	AuthorId  string        `json:"author_id,omitempty"`
+	ParentId  string        `json:"parent_id,omitempty"`
+	Edited    bool          `json:"edited,omitempty"`
+	Deleted   bool          `json:"deleted,omitempty"`
+	Reactions []Reaction    `json:"reactions,omitempty"`
+	State     DeliveryState `json:"-"`
 }
 
-type DiscoveryMessage struct {
-	Id     string   `json:"id"`
-	Name   string   `json:"name"`
-	PubKey *big.Int `json:"pub_key"`
-	Port   string   `json:"port"`
+type AckMessage struct {
+	MessageId string `json:"message_id"`
 }
 
-func (d *DiscoveryMessage) ToBytes() []byte {
-	msg := fmt.Sprintf("P2P|%s|%s|%s|%s", d.Id, d.Name, d.PubKey, d.Port)
-	return []byte(msg)
+type DiscoveryMessage struct {
+	Id          string            `json:"id"`
+	Name        string            `json:"name"`
+	Keys        map[string][]byte `json:"keys"`
+	Port        string            `json:"port"`
+	IdentityKey []byte            `json:"identity_key"`
+	Presence    Presence          `json:"presence,omitempty"`
+	Status      string            `json:"status,omitempty"`
 }
 
-func DiscoveryMessageFromBytes(bytes []byte, fcP2P, fcGe func([]string) error) error {
-	bytes = b.Trim(bytes, nullByte)
-	arrayStr := strings.Split(string(bytes), "|")
-	if len(arrayStr) != 5 {
-		return ErrBadMessage
+func (m *DiscoveryMessage) Negotiate() (string, []byte, error) {
+	schemes := make([]string, 0, len(m.Keys))
+	for scheme := range m.Keys {
+		schemes = append(schemes, scheme)
 	}
-	if arrayStr[0] == "P2P" {
-		return fcP2P(arrayStr[1:])
-	} else {
-		return fcGe(arrayStr)
+	scheme, ok := utils.NegotiateScheme(schemes)
+	if !ok {
+		return "", nil, ErrNoCommonScheme
 	}
+	return scheme, m.Keys[scheme], nil
 }
@@ -0,0 +1,226 @@
+package entity
+
+import (
+	"errors"
+	"sync"
+
+	"chat_tool/utils"
+)
+
+var (
+	errUnchanged = errors.New("unchanged")
+)
+
+type MessageStore struct {
+	mutex       sync.RWMutex
+	roomId      string
+	messages    []*ChatMessage
+	index       map[string]*ChatMessage
+	subscribers map[int]func(m ChatMessage)
+	nextId      int
+	unread      []string
+	version     uint64
+}
+
+func NewMessageStore(roomId string) *MessageStore {
+	return &MessageStore{
+		roomId:      roomId,
+		messages:    make([]*ChatMessage, 0),
+		index:       make(map[string]*ChatMessage),
+		subscribers: make(map[int]func(m ChatMessage)),
+	}
+}
+
+func (s *MessageStore) Append(m *ChatMessage) bool {
+	s.mutex.Lock()
+	if _, found := s.index[m.Id]; found {
+		s.mutex.Unlock()
+		return false
+	}
+	s.messages = append(s.messages, m)
+	s.version++
+	if m.Id != "" {
+		s.index[m.Id] = m
+	}
+	copied := *m
+	subscribers := s.snapshot()
+	s.mutex.Unlock()
+	s.notify(copied, subscribers, utils.EventMessageReceived)
+	return true
+}
+
+func (s *MessageStore) Prepend(messages []*ChatMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range messages {
+		if m.Id != "" {
+			s.index[m.Id] = m
+		}
+	}
+	s.messages = append(append(make([]*ChatMessage, 0, len(messages)+len(s.messages)), messages...), s.messages...)
+	s.version++
+}
+
+func (s *MessageStore) SetState(id string, state DeliveryState) {
+	s.update(id, utils.EventDeliveryChanged, func(m *ChatMessage) error {
+		if m.State == state || m.State == DeliverySeen {
+			return errUnchanged
+		}
+		m.State = state
+		return nil
+	})
+}
+
+func (s *MessageStore) Revise(id, authorId, content string, deleted bool) (*ChatMessage, error) {
+	return s.update(id, utils.EventMessageUpdated, func(m *ChatMessage) error {
+		if m.AuthorId == "" || m.AuthorId != authorId {
+			return ErrNotAuthor
+		}
+		if m.Deleted {
+			return ErrMessageDeleted
+		}
+		if deleted {
+			m.Content, m.Deleted = "", true
+		} else {
+			m.Content, m.Edited = content, true
+		}
+		return nil
+	})
+}
+
+func (s *MessageStore) React(id string, reaction Reaction, add bool) (*ChatMessage, error) {
+	m, err := s.update(id, utils.EventMessageUpdated, func(m *ChatMessage) error {
+		if m.Deleted {
+			return ErrMessageDeleted
+		}
+		index := m.reactionIndex(reaction.UserId, reaction.Emoji)
+		if (index >= 0) == add {
+			return errUnchanged
+		}
+		reactions := make([]Reaction, 0, len(m.Reactions)+1)
+		if add {
+			reactions = append(append(reactions, m.Reactions...), reaction)
+		} else {
+			reactions = append(append(reactions, m.Reactions[:index]...), m.Reactions[index+1:]...)
+		}
+		m.Reactions = reactions
+		return nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return nil, nil
+	}
+	return m, err
+}
+
+func (s *MessageStore) update(id string, kind utils.EventKind, fn func(m *ChatMessage) error) (*ChatMessage, error) {
+	s.mutex.Lock()
+	m, found := s.index[id]
+	if !found {
+		s.mutex.Unlock()
+		return nil, ErrUnknownMessage
+	}
+	if err := fn(m); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	s.version++
+	copied := *m
+	subscribers := s.snapshot()
+	s.mutex.Unlock()
+	s.notify(copied, subscribers, kind)
+	return &copied, nil
+}
+
+func (s *MessageStore) notify(m ChatMessage, subscribers []func(m ChatMessage), kind utils.EventKind) {
+	for _, fn := range subscribers {
+		fn(m)
+	}
+	utils.Events.Publish(utils.Event{Kind: kind, RoomId: s.roomId, MessageId: m.Id})
+}
+
+func (s *MessageStore) markUnread(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unread = append(s.unread, id)
+}
+
+func (s *MessageStore) takeUnread(visible []string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := make(map[string]bool, len(visible))
+	for _, id := range visible {
+		seen[id] = true
+	}
+	taken := make([]string, 0)
+	unread := s.unread[:0]
+	for _, id := range s.unread {
+		if seen[id] {
+			taken = append(taken, id)
+		} else {
+			unread = append(unread, id)
+		}
+	}
+	s.unread = unread
+	return taken
+}
+
+func (s *MessageStore) State(id string) DeliveryState {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if m, found := s.index[id]; found {
+		return m.State
+	}
+	return DeliveryNone
+}
+
+func (s *MessageStore) Get(id string) (ChatMessage, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if m, found := s.index[id]; found {
+		return *m, true
+	}
+	return ChatMessage{}, false
+}
+
+func (s *MessageStore) Version() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.version
+}
+
+func (s *MessageStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.messages)
+}
+
+func (s *MessageStore) Range(fn func(m ChatMessage) bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, m := range s.messages {
+		if !fn(*m) {
+			return
+		}
+	}
+}
+
+func (s *MessageStore) Subscribe(fn func(m ChatMessage)) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.nextId
+	s.nextId++
+	s.subscribers[id] = fn
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+func (s *MessageStore) snapshot() []func(m ChatMessage) {
+	subscribers := make([]func(m ChatMessage), 0, len(s.subscribers))
+	for _, fn := range s.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	return subscribers
+}
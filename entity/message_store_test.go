@@ -0,0 +1,134 @@
+package entity
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMessageStoreConcurrentAccess(t *testing.T) {
+	const writers, perWriter = 8, 100
+	s := NewMessageStore("room")
+	var notified int64
+	unsubscribe := s.Subscribe(func(m ChatMessage) {
+		atomic.AddInt64(&notified, 1)
+	})
+	defer unsubscribe()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				s.Append(&ChatMessage{Id: id, AuthorId: "author", Content: id})
+				s.SetState(id, DeliverySent)
+				s.SetState(id, DeliveryDelivered)
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				s.Range(func(m ChatMessage) bool {
+					_ = m.State
+					return true
+				})
+				s.Len()
+				s.Version()
+				s.Subscribe(func(ChatMessage) {})()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.Len() != writers*perWriter {
+		t.Fatalf("Len = %d, want %d", s.Len(), writers*perWriter)
+	}
+	s.Range(func(m ChatMessage) bool {
+		if m.State != DeliveryDelivered {
+			t.Fatalf("message %s state %d", m.Id, m.State)
+		}
+		return true
+	})
+	if want := int64(3 * writers * perWriter); atomic.LoadInt64(&notified) != want {
+		t.Fatalf("notified %d times, want %d", notified, want)
+	}
+}
+
+func TestMessageStoreConcurrentUpdates(t *testing.T) {
+	s := NewMessageStore("room")
+	s.Append(&ChatMessage{Id: "m", AuthorId: "author", Content: "original"})
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reaction := Reaction{Emoji: "👍", UserId: fmt.Sprintf("user-%d", i%4)}
+			s.React("m", reaction, true)
+			s.Revise("m", "author", fmt.Sprintf("edit %d", i), false)
+			if m, found := s.Get("m"); found {
+				_ = len(m.Reactions)
+			}
+		}(i)
+	}
+	wg.Wait()
+	m, _ := s.Get("m")
+	if len(m.Reactions) != 4 || !m.Edited {
+		t.Fatalf("reactions %d, edited %v", len(m.Reactions), m.Edited)
+	}
+	if _, err := s.Revise("m", "someone else", "spoof", false); err != ErrNotAuthor {
+		t.Fatalf("Revise by non-author = %v", err)
+	}
+}
+
+func TestMessageStoreUnsubscribe(t *testing.T) {
+	s := NewMessageStore("room")
+	calls := 0
+	unsubscribe := s.Subscribe(func(ChatMessage) {
+		calls++
+	})
+	s.Append(&ChatMessage{Id: "a"})
+	unsubscribe()
+	s.Append(&ChatMessage{Id: "b"})
+	if calls != 1 {
+		t.Fatalf("subscriber called %d times, want 1", calls)
+	}
+}
+
+func TestRoomInfoConcurrentWithGroupUpdates(t *testing.T) {
+	g := &Room{Id: "group", Name: "group", IsGroup: true}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			g.setInfo(fmt.Sprintf("group %d", i), []string{"a", "b"})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			name, members := g.Info()
+			_, _ = name, len(members)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestMessageStoreIgnoresDuplicateIds(t *testing.T) {
+	s := NewMessageStore("room")
+	if !s.Append(&ChatMessage{Id: "id", AuthorId: "self", Content: "mine"}) {
+		t.Fatal("first append rejected")
+	}
+	if s.Append(&ChatMessage{Id: "id", AuthorId: "peer", Content: "theirs"}) {
+		t.Fatal("duplicate append accepted")
+	}
+	if m, _ := s.Get("id"); m.AuthorId != "self" || s.Len() != 1 {
+		t.Fatalf("store took over id: %+v", m)
+	}
+}
@@ -0,0 +1,182 @@
+package entity
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	retryBase   = 500 * time.Millisecond
+	retryMax    = 30 * time.Second
+	ackTimeout  = 3 * time.Second
+	maxAttempts = 6
+)
+
+type DeliveryState int
+
+const (
+	DeliveryNone DeliveryState = iota
+	DeliveryPending
+	DeliverySent
+	DeliveryDelivered
+	DeliveryFailed
+	DeliverySeen
+)
+
+type Outbound struct {
+	MessageId string
+	build     func(session *Session) (*Envelope, error)
+	onState   func(DeliveryState)
+	needsAck  bool
+	wasSent   bool
+	attempts  int
+	next      time.Time
+}
+
+func (o *Outbound) setState(state DeliveryState) {
+	if o.onState != nil {
+		o.onState(state)
+	}
+}
+
+func backoff(attempts int, base time.Duration) time.Duration {
+	d := base << attempts
+	if d <= 0 || d > retryMax {
+		return retryMax
+	}
+	return d
+}
+
+type Outbox struct {
+	mutex   sync.Mutex
+	entries []*Outbound
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{
+		entries: make([]*Outbound, 0),
+	}
+}
+
+func (o *Outbox) Push(out *Outbound) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.entries = append(o.entries, out)
+}
+
+func (o *Outbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.entries)
+}
+
+func (o *Outbox) Resume() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, out := range o.entries {
+		out.next = time.Time{}
+	}
+}
+
+func (o *Outbox) due(now time.Time) []*Outbound {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	due := make([]*Outbound, 0)
+	for _, out := range append([]*Outbound{}, o.entries...) {
+		if out.next.After(now) {
+			continue
+		}
+		if out.attempts >= maxAttempts {
+			o.remove(out)
+			out.setState(DeliveryFailed)
+			continue
+		}
+		due = append(due, out)
+	}
+	return due
+}
+
+func (o *Outbox) remove(out *Outbound) bool {
+	for i, entry := range o.entries {
+		if entry == out {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Outbox) retry(out *Outbound, now time.Time) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	out.attempts++
+	out.next = now.Add(backoff(out.attempts-1, retryBase))
+}
+
+func (o *Outbox) sent(out *Outbound, now time.Time) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !out.needsAck {
+		o.remove(out)
+		return
+	}
+	if !out.wasSent {
+		out.wasSent = true
+		out.setState(DeliverySent)
+	}
+	out.attempts++
+	out.next = now.Add(backoff(out.attempts-1, ackTimeout))
+}
+
+func (o *Outbox) fail(out *Outbound) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.remove(out) {
+		out.setState(DeliveryFailed)
+	}
+}
+
+func (o *Outbox) Ack(messageId string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, out := range o.entries {
+		if out.MessageId == messageId && out.needsAck {
+			o.remove(out)
+			out.setState(DeliveryDelivered)
+			return
+		}
+	}
+}
+
+func (o *Outbox) FailAll() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, out := range o.entries {
+		out.setState(DeliveryFailed)
+	}
+	o.entries = o.entries[:0]
+}
+
+func groupDelivery(setState func(DeliveryState), recipients int) func(DeliveryState) {
+	mutex := &sync.Mutex{}
+	remaining := recipients
+	current := DeliveryPending
+	return func(state DeliveryState) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch state {
+		case DeliverySent:
+			if current == DeliveryPending {
+				current = DeliverySent
+			}
+		case DeliveryDelivered:
+			remaining--
+			if remaining == 0 && current != DeliveryFailed {
+				current = DeliveryDelivered
+			}
+		case DeliveryFailed:
+			current = DeliveryFailed
+		}
+		setState(current)
+	}
+}
@@ -0,0 +1,49 @@
+package entity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxStates(t *testing.T) {
+	o := NewOutbox()
+	states := make([]DeliveryState, 0)
+	out := &Outbound{
+		MessageId: "id",
+		needsAck:  true,
+		onState: func(state DeliveryState) {
+			states = append(states, state)
+		},
+	}
+	o.Push(out)
+	now := time.Now()
+
+	o.retry(out, now)
+	now = now.Add(retryMax)
+	if due := o.due(now); len(due) != 1 {
+		t.Fatalf("due after failed write: %d", len(due))
+	}
+	o.sent(out, now)
+	if len(states) != 1 || states[0] != DeliverySent {
+		t.Fatalf("states after first send: %v", states)
+	}
+
+	for i := 0; i < maxAttempts; i++ {
+		now = now.Add(retryMax)
+		if due := o.due(now); len(due) == 0 {
+			break
+		}
+		o.sent(out, now)
+	}
+	if out.attempts != maxAttempts {
+		t.Fatalf("attempts %d, want %d", out.attempts, maxAttempts)
+	}
+	if o.Len() != 0 || states[len(states)-1] != DeliveryFailed {
+		t.Fatalf("left %d entries, states %v", o.Len(), states)
+	}
+	for _, state := range states[:len(states)-1] {
+		if state != DeliverySent {
+			t.Fatalf("states %v", states)
+		}
+	}
+}
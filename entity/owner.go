@@ -1,34 +1,118 @@
 package entity
 
 import (
+	"sync"
+
+	"chat_tool/storage"
 	"chat_tool/utils"
+)
 
-	"github.com/google/uuid"
+const (
+	generalRoomId = "00000000-0000-0000-0000-00000000000"
 )
 
 type Owner struct {
-	Id   string
-	Name string
-	Port string
-	DH   utils.DiffieHellman
-	Repo *RoomRepository
+	Id       string
+	Name     string
+	Port     string
+	Keys     map[string]utils.KeyAgreement
+	Identity *utils.Identity
+	Trust    *TrustStore
+	Settings *SettingsStore
+	Repo     *RoomRepository
+
+	store         *storage.Store
+	groupMutex    sync.Mutex
+	presenceMutex sync.Mutex
+	presence      Presence
+	status        string
 }
 
-func NewOwner(name, port string, broadcastChanBuffer int) *Owner {
+func NewOwner(name, port string, broadcastChanBuffer int, store *storage.Store, retention Retention) (*Owner, error) {
+	identity, err := LoadIdentity(store)
+	if err != nil {
+		return nil, err
+	}
+	trust, err := NewTrustStore(store)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]utils.KeyAgreement, len(utils.KeySchemes))
+	for _, scheme := range utils.KeySchemes {
+		if keys[scheme], err = utils.NewKeyAgreement(scheme); err != nil {
+			return nil, err
+		}
+	}
+	settings, err := NewSettingsStore(store)
+	if err != nil {
+		return nil, err
+	}
 	o := &Owner{
-		Id:   uuid.NewString(),
-		Name: name,
-		Port: port,
-		DH:   utils.NewDiffieHellman(),
-		Repo: NewRoomRepository(),
+		Id:       identity.Id(),
+		Name:     name,
+		Port:     port,
+		Keys:     keys,
+		Identity: identity,
+		Trust:    trust,
+		Settings: settings,
+		Repo:     NewRoomRepository(NewHistory(store, retention)),
+		store:    store,
 	}
 	o.Repo.Add(&Room{
-		Id:            "00000000-0000-0000-0000-00000000000",
+		Id:            generalRoomId,
 		Name:          "General",
 		Host:          "",
-		Messages:      make([]*ChatMessage, 0),
+		Messages:      NewMessageStore(generalRoomId),
 		IsGeneral:     true,
-		BroadcastChan: make(chan *ChatMessage, broadcastChanBuffer),
+		BroadcastChan: make(chan *Envelope, broadcastChanBuffer),
 	})
-	return o
+	if err := o.loadGroups(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Owner) PublicKeys() map[string][]byte {
+	keys := make(map[string][]byte, len(o.Keys))
+	for scheme, ka := range o.Keys {
+		keys[scheme] = ka.Public()
+	}
+	return keys
+}
+
+func (o *Owner) SendMessage(r *Room, m *ChatMessage) error {
+	if r.IsGroup {
+		return o.SendGroupMessage(r, m)
+	}
+	return r.SendMessage(o.Id, m)
+}
+
+func (o *Owner) SendAck(peer *Room, messageId string) error {
+	return o.sendSealed(peer, KindAck, &AckMessage{MessageId: messageId})
+}
+
+func (o *Owner) HandleAck(peer *Room, env *Envelope) error {
+	ack := &AckMessage{}
+	if _, err := o.openSealed(peer, env, ack); err != nil {
+		return err
+	}
+	peer.Acknowledge(ack.MessageId)
+	return nil
+}
+
+func (o *Owner) SafetyNumber(r *Room) string {
+	return utils.SafetyNumber(o.Identity.PublicKey, r.IdentityKey)
+}
+
+func (o *Owner) SetVerified(r *Room, verified bool) error {
+	if err := o.Trust.SetVerified(r.Id, verified); err != nil {
+		return err
+	}
+	if verified {
+		r.Trust = TrustVerified
+	} else {
+		r.Trust = TrustKnown
+	}
+	r.changed()
+	return nil
 }
@@ -0,0 +1,75 @@
+package entity
+
+import (
+	"strings"
+
+	"chat_tool/utils"
+)
+
+const (
+	maxStatusLength = 80
+)
+
+type Presence int
+
+const (
+	PresenceOnline Presence = iota
+	PresenceAway
+	PresenceBusy
+	PresenceInvisible
+)
+
+var (
+	Presences = []Presence{PresenceOnline, PresenceAway, PresenceBusy, PresenceInvisible}
+)
+
+func (p Presence) String() string {
+	switch p {
+	case PresenceAway:
+		return "away"
+	case PresenceBusy:
+		return "busy"
+	case PresenceInvisible:
+		return "invisible"
+	}
+	return "online"
+}
+
+func normalizeStatus(status string) string {
+	status = strings.TrimSpace(strings.ReplaceAll(status, "\n", " "))
+	if r := []rune(status); len(r) > maxStatusLength {
+		status = string(r[:maxStatusLength])
+	}
+	return status
+}
+
+func (o *Owner) Presence() (Presence, string) {
+	o.presenceMutex.Lock()
+	defer o.presenceMutex.Unlock()
+	return o.presence, o.status
+}
+
+func (o *Owner) SetPresence(p Presence, status string) {
+	o.presenceMutex.Lock()
+	o.presence, o.status = p, normalizeStatus(status)
+	o.presenceMutex.Unlock()
+	utils.Events.Publish(utils.Event{Kind: utils.EventPresenceChanged})
+}
+
+func (r *Room) Presence() (Presence, string) {
+	r.presenceMutex.Lock()
+	defer r.presenceMutex.Unlock()
+	return r.presence, r.status
+}
+
+func (r *Room) SetPresence(p Presence, status string) {
+	status = normalizeStatus(status)
+	r.presenceMutex.Lock()
+	if r.presence == p && r.status == status {
+		r.presenceMutex.Unlock()
+		return
+	}
+	r.presence, r.status = p, status
+	r.presenceMutex.Unlock()
+	r.changed()
+}
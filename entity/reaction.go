@@ -0,0 +1,82 @@
+package entity
+
+const (
+	maxEmojiLength = 8
+)
+
+var (
+	Emojis = []string{"👍", "❤️", "😂", "😮", "😢", "🎉"}
+)
+
+type Reaction struct {
+	Emoji  string `json:"emoji"`
+	UserId string `json:"user_id"`
+	User   string `json:"user"`
+}
+
+type ReactionMessage struct {
+	RoomId    string `json:"room_id,omitempty"`
+	MessageId string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Removed   bool   `json:"removed,omitempty"`
+}
+
+func (m *ChatMessage) HasReaction(userId, emoji string) bool {
+	return m.reactionIndex(userId, emoji) >= 0
+}
+
+func (m *ChatMessage) reactionIndex(userId, emoji string) int {
+	for i, reaction := range m.Reactions {
+		if reaction.UserId == userId && reaction.Emoji == emoji {
+			return i
+		}
+	}
+	return -1
+}
+
+func validEmoji(emoji string) bool {
+	n := len([]rune(emoji))
+	return n > 0 && n <= maxEmojiLength
+}
+
+func (r *Room) React(id string, reaction Reaction, add bool) error {
+	if !validEmoji(reaction.Emoji) {
+		return ErrBadMessage
+	}
+	m, err := r.Messages.React(id, reaction, add)
+	if err != nil || m == nil {
+		return err
+	}
+	r.persist(m)
+	return nil
+}
+
+func (o *Owner) ToggleReaction(r *Room, id, emoji string) error {
+	m, found := r.Messages.Get(id)
+	if !found {
+		return ErrUnknownMessage
+	}
+	removed := m.HasReaction(o.Id, emoji)
+	if err := r.React(id, Reaction{Emoji: emoji, UserId: o.Id, User: o.Name}, !removed); err != nil {
+		return err
+	}
+	return o.sendToRoom(r, KindReaction, func(roomId string) any {
+		return &ReactionMessage{RoomId: roomId, MessageId: id, Emoji: emoji, Removed: removed}
+	})
+}
+
+func (o *Owner) HandleReaction(peer *Room, env *Envelope) error {
+	m := &ReactionMessage{}
+	isNew, err := o.openSealed(peer, env, m)
+	if err != nil {
+		return err
+	}
+	if err := o.SendAck(peer, env.MessageId); err != nil || !isNew {
+		return err
+	}
+	target, err := o.sharedRoom(peer, m.RoomId)
+	if err != nil {
+		return err
+	}
+	return target.React(m.MessageId, Reaction{Emoji: m.Emoji, UserId: peer.Id, User: peer.Name}, !m.Removed)
+}
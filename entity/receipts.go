@@ -0,0 +1,36 @@
+package entity
+
+type ReadMessage struct {
+	MessageIds []string `json:"message_ids"`
+}
+
+func (r *Room) Receive(m *ChatMessage) {
+	if r.Append(m) && !r.IsGeneral && !r.IsGroup {
+		r.Messages.markUnread(m.Id)
+	}
+}
+
+func (o *Owner) MarkRead(peer *Room, visible []string) error {
+	ids := peer.Messages.takeUnread(visible)
+	if len(ids) == 0 || !o.Settings.Get().ReadReceipts {
+		return nil
+	}
+	return o.sendSealed(peer, KindRead, &ReadMessage{MessageIds: ids})
+}
+
+func (o *Owner) HandleRead(peer *Room, env *Envelope) error {
+	m := &ReadMessage{}
+	isNew, err := o.openSealed(peer, env, m)
+	if err != nil {
+		return err
+	}
+	if err := o.SendAck(peer, env.MessageId); err != nil || !isNew {
+		return err
+	}
+	for _, id := range m.MessageIds {
+		if message, found := peer.Messages.Get(id); found && message.AuthorId == o.Id {
+			peer.Messages.SetState(id, DeliverySeen)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package entity
+
+import (
+	"errors"
+
+	"chat_tool/utils"
+)
+
+var (
+	ErrUnknownMessage = errors.New("ErrorUnknownMessage")
+	ErrNotAuthor      = errors.New("ErrorNotAuthor")
+	ErrMessageDeleted = errors.New("ErrorMessageDeleted")
+)
+
+type EditMessage struct {
+	RoomId    string `json:"room_id,omitempty"`
+	MessageId string `json:"message_id"`
+	Content   string `json:"content,omitempty"`
+}
+
+func (r *Room) Revise(id, authorId, content string, deleted bool) error {
+	m, err := r.Messages.Revise(id, authorId, content, deleted)
+	if err != nil {
+		return err
+	}
+	r.persist(m)
+	return nil
+}
+
+func (r *Room) persist(m *ChatMessage) {
+	if r.history == nil {
+		return
+	}
+	if err := r.history.Append(r.Id, m); err != nil {
+		utils.LL.Error("Room-History: %s", err.Error())
+	}
+}
+
+func (o *Owner) EditMessage(r *Room, id, content string) error {
+	if err := r.Revise(id, o.Id, content, false); err != nil {
+		return err
+	}
+	return o.sendToRoom(r, KindEdit, func(roomId string) any {
+		return &EditMessage{RoomId: roomId, MessageId: id, Content: content}
+	})
+}
+
+func (o *Owner) DeleteMessage(r *Room, id string) error {
+	if err := r.Revise(id, o.Id, "", true); err != nil {
+		return err
+	}
+	return o.sendToRoom(r, KindDelete, func(roomId string) any {
+		return &EditMessage{RoomId: roomId, MessageId: id}
+	})
+}
+
+func (o *Owner) sendToRoom(r *Room, kind EnvelopeKind, payload func(roomId string) any) error {
+	switch {
+	case r.IsGeneral:
+		env, err := NewEnvelope(kind, o.Id, payload(r.Id))
+		if err != nil {
+			return err
+		}
+		return r.broadcast(env)
+	case r.IsGroup:
+		o.groupMutex.Lock()
+		members := withoutMember(r.Members, o.Id)
+		o.groupMutex.Unlock()
+		for _, member := range members {
+			if peer, found := o.Repo.Get(member); found {
+				if err := o.sendSealed(peer, kind, payload(r.Id)); err != nil {
+					utils.LL.Error("Group: %s to %s %s", kind, peer.Name, err.Error())
+				}
+			}
+		}
+		return nil
+	}
+	return o.sendSealed(r, kind, payload(""))
+}
+
+func (o *Owner) sharedRoom(peer *Room, roomId string) (*Room, error) {
+	if roomId == "" {
+		return peer, nil
+	}
+	g, found := o.Repo.Get(roomId)
+	if !found || !g.IsGroup {
+		return nil, ErrNotMember
+	}
+	o.groupMutex.Lock()
+	isMember := g.IsMember(peer.Id)
+	o.groupMutex.Unlock()
+	if !isMember {
+		return nil, ErrNotMember
+	}
+	return g, nil
+}
+
+func (o *Owner) HandleRevision(peer *Room, env *Envelope) error {
+	m := &EditMessage{}
+	isNew, err := o.openSealed(peer, env, m)
+	if err != nil {
+		return err
+	}
+	if err := o.SendAck(peer, env.MessageId); err != nil || !isNew {
+		return err
+	}
+	target, err := o.sharedRoom(peer, m.RoomId)
+	if err != nil {
+		return err
+	}
+	return target.Revise(m.MessageId, peer.Id, m.Content, env.Kind == KindDelete)
+}
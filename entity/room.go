@@ -3,8 +3,6 @@ package entity
 import (
 	"context"
 	"errors"
-	"fmt"
-	"math/big"
 	"net"
 	"net/http"
 	"sort"
@@ -13,6 +11,7 @@ import (
 
 	"chat_tool/utils"
 
+	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
 )
 
@@ -23,120 +22,384 @@ var (
 			Dial: dialer.Dial,
 		},
 	}
-	pingDelay       = time.Second
+	retryTick       = 250 * time.Millisecond
+	seenSize        = 1024
 	ErrDisconnected = errors.New("disconnected")
 )
 
 type Room struct {
 	Id            string
 	Name          string
-	PubKey        *big.Int
+	infoMutex     sync.RWMutex
+	KeyScheme     string
+	PubKey        []byte
+	keyMutex      sync.Mutex
+	keys          *peerKeys
+	IdentityKey   []byte
+	Trust         TrustStatus
 	Host          string
-	Messages      []*ChatMessage
+	Messages      *MessageStore
 	IsGeneral     bool
-	BroadcastChan chan *ChatMessage
-	WSChan        chan string
-	wsConn        *websocket.Conn
+	IsGroup       bool
+	Admin         string
+	Members       []string
+	Epoch         uint64
+	groupKey      []byte
+	groupReplay   map[string]*utils.ReplayWindow
+	BroadcastChan chan *Envelope
+	WSChan        chan *Outbound
+	conn          *ConnManager
+	connGen       uint64
+	outbox        *Outbox
+	closed        chan struct{}
+	closeOnce     sync.Once
+	sendCounter   uint64
+	seen          *utils.RecentSet
+	history       *History
+	lastSeen      int64
+	probing       int32
+	presenceMutex sync.Mutex
+	presence      Presence
+	status        string
+	typingUntil   time.Time
+}
+
+func NewRoom(id, name, host, keyScheme string, pubKey, identityKey []byte) *Room {
+	return &Room{
+		Id:          id,
+		Name:        name,
+		KeyScheme:   keyScheme,
+		PubKey:      pubKey,
+		IdentityKey: identityKey,
+		Host:        host,
+		Messages:    NewMessageStore(id),
+		IsGeneral:   false,
+		WSChan:      make(chan *Outbound, 10),
+		conn:        NewConnManager(host, id),
+		outbox:      NewOutbox(),
+		closed:      make(chan struct{}),
+		seen:        utils.NewRecentSet(seenSize),
+		lastSeen:    time.Now().UnixNano(),
+	}
 }
 
 func (r *Room) Close() {
-	if r.WSChan != nil {
-		close(r.WSChan)
+	if r.closed != nil {
+		r.closeOnce.Do(func() {
+			close(r.closed)
+		})
 	}
 }
 
+func (r *Room) Bind(o *Owner, handler FrameHandler) {
+	r.conn.bind(o.Id, func(conn *websocket.Conn) (*Session, error) {
+		return o.dialHandshake(r, conn)
+	}, func(env *Envelope) {
+		handler(r, env)
+	}, func() {
+		o.PeerJoined(r)
+	})
+}
+
+func (r *Room) Accept(conn *websocket.Conn, session *Session) error {
+	return r.conn.Accept(conn, session)
+}
+
+func (r *Room) Serve(conn *websocket.Conn, session *Session) {
+	r.conn.Serve(conn, session)
+}
+
 func (r *Room) HandleWS(ctx context.Context) {
+	ticker := time.NewTicker(retryTick)
+	defer func() {
+		ticker.Stop()
+		r.outbox.FailAll()
+		r.conn.Close()
+	}()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case msg, ok := <-r.WSChan:
-			if !ok {
-				return
-			}
-			if r.wsConn != nil {
-				if _, err := r.wsConn.Write([]byte(msg)); err != nil {
-					utils.LL.Error("Room-HandleWS: %s", err.Error())
-					return
-				}
-			} else {
-				origin := fmt.Sprintf("http://%s/", r.Host)
-				url := fmt.Sprintf("ws://%s/ws", r.Host)
-				ws, err := websocket.Dial(url, "", origin)
-				if err != nil {
-					utils.LL.Error("Room-HandleWS: %s", err.Error())
-					return
-				}
-				if _, err := ws.Write([]byte(msg)); err != nil {
-					utils.LL.Error("Room-HandleWS: %s", err.Error())
-					return
-				}
-				r.wsConn = ws
-			}
+		case <-r.closed:
+			return
+		case out := <-r.WSChan:
+			r.outbox.Push(out)
+			r.flush()
+		case <-ticker.C:
+			r.conn.Heartbeat()
+			r.flush()
 		}
 	}
 }
 
-func (r *Room) AddMessage(text, author string) {
-	r.Messages = append(r.Messages, &ChatMessage{
-		Time:    time.Now(),
-		Content: text,
-		Author:  author,
-	})
+func (r *Room) Info() (string, []string) {
+	r.infoMutex.RLock()
+	defer r.infoMutex.RUnlock()
+	return r.Name, r.Members
+}
+
+func (r *Room) Addr() string {
+	r.infoMutex.RLock()
+	defer r.infoMutex.RUnlock()
+	return r.Host
+}
+
+func (r *Room) SetHost(host string) bool {
+	r.infoMutex.Lock()
+	if r.Host == host {
+		r.infoMutex.Unlock()
+		return false
+	}
+	r.Host = host
+	r.infoMutex.Unlock()
+	if r.conn != nil {
+		r.conn.SetHost(host)
+	}
+	r.changed()
+	return true
+}
+
+func (r *Room) setInfo(name string, members []string) {
+	r.infoMutex.Lock()
+	defer r.infoMutex.Unlock()
+	r.Name, r.Members = name, members
 }
 
-func (r *Room) sendBroadcastMessage(id string) error {
-	if len(r.Messages) > 0 {
-		r.BroadcastChan <- r.Messages[len(r.Messages)-1]
+func (r *Room) changed() {
+	utils.Events.Publish(utils.Event{Kind: utils.EventRoomUpdated, RoomId: r.Id})
+}
+
+func (r *Room) ConnState() ConnState {
+	if r.conn == nil {
+		return ConnIdle
 	}
-	return nil
+	return r.conn.State()
 }
 
-func (r *Room) sendWSMessage(id, encryptedMessage string) error {
-	r.WSChan <- fmt.Sprintf("%s|%s", id, encryptedMessage)
-	return nil
+func (r *Room) flush() {
+	if r.outbox.Len() == 0 {
+		return
+	}
+	conn, session, gen, err := r.conn.Conn()
+	if err != nil {
+		if !errors.Is(err, ErrBackingOff) {
+			utils.LL.Error("Room-HandleWS: %s", err.Error())
+		}
+		return
+	}
+	if gen != r.connGen {
+		r.connGen = gen
+		r.outbox.Resume()
+	}
+	now := time.Now()
+	for _, out := range r.outbox.due(now) {
+		env, err := out.build(session)
+		if err != nil {
+			utils.LL.Error("Room-HandleWS: %s", err.Error())
+			r.outbox.fail(out)
+			continue
+		}
+		msg, err := EncodeEnvelope(env)
+		if err != nil {
+			utils.LL.Error("Room-HandleWS: %s", err.Error())
+			r.outbox.fail(out)
+			continue
+		}
+		if err := websocket.Message.Send(conn, msg); err != nil {
+			r.conn.Fail(conn, err)
+			r.outbox.retry(out, now)
+			return
+		}
+		r.outbox.sent(out, now)
+	}
+}
+
+func (r *Room) AddMessage(text, authorId, author string) *ChatMessage {
+	return r.AddReply(text, "", authorId, author)
+}
+
+func (r *Room) AddReply(text, parentId, authorId, author string) *ChatMessage {
+	m := &ChatMessage{
+		Id:       uuid.NewString(),
+		Time:     time.Now(),
+		Content:  text,
+		Author:   author,
+		AuthorId: authorId,
+		ParentId: parentId,
+	}
+	r.Append(m)
+	return m
+}
+
+func (r *Room) Append(m *ChatMessage) bool {
+	if !r.Messages.Append(m) {
+		return false
+	}
+	r.persist(m)
+	return true
+}
+
+func (r *Room) enqueue(out *Outbound) error {
+	select {
+	case <-r.closed:
+		return ErrDisconnected
+	case r.WSChan <- out:
+		return nil
+	}
+}
+
+func (r *Room) Acknowledge(messageId string) {
+	if r.outbox != nil {
+		r.outbox.Ack(messageId)
+	}
 }
 
-func (r *Room) SendMessage(id, message string, dh utils.DiffieHellman) error {
+func (r *Room) sealEnvelope(session *Session, kind EnvelopeKind, ownerId, messageId string, plainText []byte) (*Envelope, error) {
+	if session == nil {
+		return nil, ErrNoSession
+	}
+	counter, cipherText, err := session.seal(plainText, func(counter uint64) []byte {
+		return utils.AssociatedData(string(kind), r.Id, ownerId, messageId, counter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	env, err := NewEnvelope(kind, ownerId, &PrivatePayload{
+		Counter: counter,
+		Cipher:  cipherText,
+	})
+	if err != nil {
+		return nil, err
+	}
+	env.MessageId = messageId
+	return env, nil
+}
+
+func (r *Room) open(env *Envelope, ownerId string) ([]byte, error) {
+	if env.session == nil {
+		return nil, ErrNoSession
+	}
+	payload := &PrivatePayload{}
+	if err := env.Decode(payload); err != nil {
+		return nil, err
+	}
+	return env.session.open(payload.Counter, payload.Cipher, utils.AssociatedData(string(env.Kind), ownerId, r.Id, env.MessageId, payload.Counter))
+}
+
+func (r *Room) SendMessage(id string, m *ChatMessage) error {
 	if r.IsGeneral {
-		return r.sendBroadcastMessage(id)
+		env, err := NewEnvelope(KindChat, id, &ChatPayload{
+			RoomId:   r.Id,
+			Content:  m.Content,
+			Author:   m.Author,
+			ParentId: m.ParentId,
+		})
+		if err != nil {
+			return err
+		}
+		env.MessageId = m.Id
+		env.Time = m.Time.UTC()
+		if err := r.broadcast(env); err != nil {
+			r.Messages.SetState(m.Id, DeliveryFailed)
+			return err
+		}
+		return nil
 	}
 
-	encryptedMessage, err := utils.EncryptMessage(utils.GetSecret(r.PubKey, dh), message)
+	plainText, err := sealedChat(m)
+	if err != nil {
+		return err
+	}
+	r.Messages.SetState(m.Id, DeliveryPending)
+	return r.enqueue(&Outbound{
+		MessageId: m.Id,
+		needsAck:  true,
+		onState: func(state DeliveryState) {
+			r.Messages.SetState(m.Id, state)
+		},
+		build: func(session *Session) (*Envelope, error) {
+			return r.sealEnvelope(session, KindPrivate, id, m.Id, plainText)
+		},
+	})
+}
+
+func (r *Room) broadcast(env *Envelope) error {
+	bytes, err := EncodeEnvelope(env)
 	if err != nil {
 		return err
 	}
-	return r.sendWSMessage(id, encryptedMessage)
+	if len(bytes)+broadcastOverhead > MaxBroadcastSize {
+		return ErrMessageTooLarge
+	}
+	select {
+	case r.BroadcastChan <- env:
+		return nil
+	default:
+		return ErrBroadcastBusy
+	}
+}
+
+func (r *Room) OpenMessage(env *Envelope, ownerId string) (*ChatMessage, bool, error) {
+	plainText, err := r.open(env, ownerId)
+	if err != nil {
+		return nil, false, err
+	}
+	payload, err := openedChat(plainText)
+	if err != nil {
+		return nil, false, err
+	}
+	m := &ChatMessage{
+		Id:       env.MessageId,
+		Time:     env.Time,
+		Content:  payload.Content,
+		Author:   r.Name,
+		AuthorId: r.Id,
+		ParentId: payload.ParentId,
+	}
+	return m, r.seen.Add(env.MessageId), nil
 }
 
 type RoomRepository struct {
 	rwMutex *sync.RWMutex
 	rooms   map[string]*Room
-	Updated chan string
+	history *History
 }
 
-func NewRoomRepository() *RoomRepository {
+func NewRoomRepository(history *History) *RoomRepository {
 	repo := &RoomRepository{
 		rwMutex: &sync.RWMutex{},
 		rooms:   make(map[string]*Room),
-		Updated: make(chan string),
+		history: history,
 	}
-	repo.Ping()
 	return repo
 }
 
 func (r *RoomRepository) Add(room *Room) {
 	r.rwMutex.Lock()
 	defer r.rwMutex.Unlock()
-	if _, found := r.rooms[room.Id]; !found {
-		r.rooms[room.Id] = room
+	if _, found := r.rooms[room.Id]; found {
+		return
 	}
+	if r.history != nil {
+		messages, err := r.history.Load(room.Id)
+		if err != nil {
+			utils.LL.Error("Repo-History: %s", err.Error())
+		}
+		room.Messages.Prepend(messages)
+		room.history = r.history
+	}
+	r.rooms[room.Id] = room
+	utils.Events.Publish(utils.Event{Kind: utils.EventRoomAdded, RoomId: room.Id})
 }
 
 func (r *RoomRepository) Delete(id string) {
-	r.rwMutex.RLock()
-	defer r.rwMutex.RUnlock()
+	r.rwMutex.Lock()
+	_, found := r.rooms[id]
 	delete(r.rooms, id)
+	r.rwMutex.Unlock()
+	if found {
+		utils.Events.Publish(utils.Event{Kind: utils.EventRoomRemoved, RoomId: id})
+	}
 }
 
 func (r *RoomRepository) Get(id string) (*Room, bool) {
@@ -147,6 +410,8 @@ func (r *RoomRepository) Get(id string) (*Room, bool) {
 }
 
 func (r *RoomRepository) GetGeneralRooms() []*Room {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
 	roomsSlice := make([]*Room, 0)
 	for _, room := range r.rooms {
 		if room.IsGeneral {
@@ -157,6 +422,8 @@ func (r *RoomRepository) GetGeneralRooms() []*Room {
 }
 
 func (r *RoomRepository) GetRooms() []*Room {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
 	roomsSlice := make([]*Room, 0, len(r.rooms))
 	for _, room := range r.rooms {
 		roomsSlice = append(roomsSlice, room)
@@ -166,35 +433,3 @@ func (r *RoomRepository) GetRooms() []*Room {
 	})
 	return roomsSlice
 }
-
-func (r *RoomRepository) Ping() {
-	ticker := time.NewTicker(pingDelay)
-
-	go func() {
-		for {
-			<-ticker.C
-			for _, room := range r.GetRooms() {
-				if room.IsGeneral {
-					continue
-				}
-				req, err := http.NewRequest("HEAD", "http://"+room.Host, nil)
-				if err != nil {
-					utils.LL.Error("PING: NewRequest %s", err.Error())
-					continue
-				}
-				resp, err := httpClient.Do(req)
-				if err != nil {
-					utils.LL.Error("PING: Do %s", err.Error())
-					room.Close()
-					r.Delete(room.Id)
-					r.Updated <- room.Id
-					continue
-				}
-				resp.Body.Close()
-				if resp.StatusCode != 200 {
-					utils.LL.Error("PING: Status %d", resp.StatusCode)
-				}
-			}
-		}
-	}()
-}
@@ -0,0 +1,48 @@
+package entity
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGeneralSendNeverBlocks(t *testing.T) {
+	r := &Room{
+		Id:            generalRoomId,
+		Messages:      NewMessageStore(generalRoomId),
+		IsGeneral:     true,
+		BroadcastChan: make(chan *Envelope, 1),
+	}
+
+	large := r.AddMessage(strings.Repeat("x", MaxBroadcastSize), "self", "me")
+	if err := r.SendMessage("self", large); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("oversized send: %v", err)
+	}
+	if r.Messages.State(large.Id) != DeliveryFailed {
+		t.Fatalf("oversized state: %v", r.Messages.State(large.Id))
+	}
+
+	first := r.AddMessage("first", "self", "me")
+	if err := r.SendMessage("self", first); err != nil {
+		t.Fatal(err)
+	}
+	second := r.AddMessage("second", "self", "me")
+	if err := r.SendMessage("self", second); !errors.Is(err, ErrBroadcastBusy) {
+		t.Fatalf("full queue send: %v", err)
+	}
+	if r.Messages.State(second.Id) != DeliveryFailed {
+		t.Fatalf("full queue state: %v", r.Messages.State(second.Id))
+	}
+	if env := <-r.BroadcastChan; env.MessageId != first.Id {
+		t.Fatalf("queued %s, want %s", env.MessageId, first.Id)
+	}
+}
+
+func TestRoomKeepsInvisiblePresence(t *testing.T) {
+	r := &Room{Id: "peer"}
+	r.SetPresence(PresenceOnline, "here")
+	r.SetPresence(PresenceInvisible, "")
+	if presence, status := r.Presence(); presence != PresenceInvisible || status != "" {
+		t.Fatalf("presence %s %q", presence, status)
+	}
+}
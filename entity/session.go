@@ -0,0 +1,111 @@
+package entity
+
+import (
+	"bytes"
+	"errors"
+
+	"chat_tool/utils"
+)
+
+const (
+	peerKeyLabel      = "chat_tool peer key"
+	sessionChainLabel = "chat_tool session chain"
+)
+
+var (
+	ErrNoSession = errors.New("ErrorNoSession")
+)
+
+type Session struct {
+	send *utils.Ratchet
+	recv *utils.Ratchet
+}
+
+func newSession(keys *peerKeys, ephemeralSecret, transcript []byte) (*Session, error) {
+	send, err := utils.DeriveSecret(append(append([]byte{}, keys.send...), ephemeralSecret...), transcript, sessionChainLabel)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := utils.DeriveSecret(append(append([]byte{}, keys.recv...), ephemeralSecret...), transcript, sessionChainLabel)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		send: utils.NewRatchet(send),
+		recv: utils.NewRatchet(recv),
+	}, nil
+}
+
+func (s *Session) seal(plainText []byte, ad func(counter uint64) []byte) (uint64, []byte, error) {
+	counter, messageKey := s.send.Next()
+	cipherText, err := utils.SealMessage(messageKey, string(plainText), ad(counter))
+	return counter, cipherText, err
+}
+
+func (s *Session) open(counter uint64, cipherText, ad []byte) ([]byte, error) {
+	var plainText string
+	err := s.recv.Open(counter, func(messageKey []byte) error {
+		var err error
+		plainText, err = utils.OpenMessage(messageKey, cipherText, ad)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(plainText), nil
+}
+
+type peerKeys struct {
+	scheme string
+	local  []byte
+	remote []byte
+	send   []byte
+	recv   []byte
+}
+
+func (r *Room) peerKeys(o *Owner) (*peerKeys, error) {
+	r.keyMutex.Lock()
+	defer r.keyMutex.Unlock()
+	if r.keys != nil {
+		return r.keys, nil
+	}
+	static, found := o.Keys[r.KeyScheme]
+	if !found {
+		return nil, utils.ErrUnknownScheme
+	}
+	secret, err := utils.GetSecret(r.PubKey, static)
+	if err != nil {
+		return nil, err
+	}
+	send, err := utils.DeriveSecret(secret, nil, peerKeyLabel+"|"+o.Id+"|"+r.Id)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := utils.DeriveSecret(secret, nil, peerKeyLabel+"|"+r.Id+"|"+o.Id)
+	if err != nil {
+		return nil, err
+	}
+	r.keys = &peerKeys{
+		scheme: r.KeyScheme,
+		local:  static.Public(),
+		remote: r.PubKey,
+		send:   send,
+		recv:   recv,
+	}
+	return r.keys, nil
+}
+
+func (r *Room) SetPublicKey(scheme string, pubKey []byte) bool {
+	r.keyMutex.Lock()
+	if scheme == r.KeyScheme && bytes.Equal(pubKey, r.PubKey) {
+		r.keyMutex.Unlock()
+		return false
+	}
+	r.KeyScheme, r.PubKey, r.keys = scheme, pubKey, nil
+	r.keyMutex.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.changed()
+	return true
+}
@@ -0,0 +1,90 @@
+package entity
+
+import (
+	"testing"
+
+	"chat_tool/utils"
+)
+
+func benchmarkPeer(b *testing.B, scheme, id string) (*Owner, utils.KeyAgreement) {
+	ka, err := utils.NewKeyAgreement(scheme)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &Owner{Id: id, Keys: map[string]utils.KeyAgreement{scheme: ka}}, ka
+}
+
+func BenchmarkPeerKeys(b *testing.B) {
+	plainText := []byte("hello | world")
+	ephemeralSecret := make([]byte, 32)
+	transcript := []byte("transcript")
+	for _, scheme := range utils.KeySchemes {
+		alice, aliceKey := benchmarkPeer(b, scheme, "alice")
+		bob, bobKey := benchmarkPeer(b, scheme, "bob")
+		toBob := &Room{Id: bob.Id, KeyScheme: scheme, PubKey: bobKey.Public()}
+		toAlice := &Room{Id: alice.Id, KeyScheme: scheme, PubKey: aliceKey.Public()}
+
+		b.Run(scheme+"/cached", func(b *testing.B) {
+			sendKeys, err := toBob.peerKeys(alice)
+			if err != nil {
+				b.Fatal(err)
+			}
+			recvKeys, err := toAlice.peerKeys(bob)
+			if err != nil {
+				b.Fatal(err)
+			}
+			send, err := newSession(sendKeys, ephemeralSecret, transcript)
+			if err != nil {
+				b.Fatal(err)
+			}
+			recv, err := newSession(recvKeys, ephemeralSecret, transcript)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ad := func(counter uint64) []byte {
+				return utils.AssociatedData(string(KindPrivate), bob.Id, alice.Id, "id", counter)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := toBob.peerKeys(alice); err != nil {
+					b.Fatal(err)
+				}
+				counter, cipherText, err := send.seal(plainText, ad)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := recv.open(counter, cipherText, ad(counter)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(scheme+"/full", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sendSecret, err := utils.GetSecret(bobKey.Public(), aliceKey)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sendKey, err := utils.DeriveSecret(sendSecret, nil, peerKeyLabel)
+				if err != nil {
+					b.Fatal(err)
+				}
+				cipherText, err := utils.SealMessage(sendKey, string(plainText), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				recvSecret, err := utils.GetSecret(aliceKey.Public(), bobKey)
+				if err != nil {
+					b.Fatal(err)
+				}
+				recvKey, err := utils.DeriveSecret(recvSecret, nil, peerKeyLabel)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := utils.OpenMessage(recvKey, cipherText, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
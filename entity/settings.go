@@ -0,0 +1,63 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"chat_tool/storage"
+)
+
+const settingsRecord = "settings.json"
+
+type Settings struct {
+	TypingIndicators bool `json:"typing_indicators"`
+	ReadReceipts     bool `json:"read_receipts"`
+}
+
+type SettingsStore struct {
+	mutex    sync.Mutex
+	store    *storage.Store
+	settings Settings
+}
+
+func NewSettingsStore(store *storage.Store) (*SettingsStore, error) {
+	s := &SettingsStore{
+		store: store,
+		settings: Settings{
+			TypingIndicators: true,
+			ReadReceipts:     true,
+		},
+	}
+	data, err := store.Get(settingsRecord)
+	if errors.Is(err, storage.ErrNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.settings); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SettingsStore) Get() Settings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.settings
+}
+
+func (s *SettingsStore) Set(settings Settings) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Put(settingsRecord, data); err != nil {
+		return err
+	}
+	s.settings = settings
+	return nil
+}
@@ -0,0 +1,117 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"chat_tool/storage"
+	"chat_tool/utils"
+)
+
+const trustRecord = "trust.json"
+
+type TrustStatus int
+
+const (
+	TrustNew TrustStatus = iota + 1
+	TrustKnown
+	TrustVerified
+	TrustChanged
+)
+
+type TrustRecord struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"`
+	Verified    bool      `json:"verified"`
+	FirstSeen   time.Time `json:"first_seen"`
+	Supersedes  string    `json:"supersedes,omitempty"`
+}
+
+type TrustStore struct {
+	mutex   sync.Mutex
+	store   *storage.Store
+	records map[string]*TrustRecord
+}
+
+func NewTrustStore(store *storage.Store) (*TrustStore, error) {
+	t := &TrustStore{
+		store:   store,
+		records: make(map[string]*TrustRecord),
+	}
+	data, err := store.Get(trustRecord)
+	if errors.Is(err, storage.ErrNotFound) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.records); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TrustStore) Observe(id, name string, identityKey []byte) (TrustStatus, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fingerprint := utils.Fingerprint(identityKey)
+	if record, found := t.records[id]; found {
+		if record.Fingerprint != fingerprint {
+			return TrustChanged, nil
+		}
+		if record.Name != name {
+			record.Name = name
+			if err := t.save(); err != nil {
+				return TrustKnown, err
+			}
+		}
+		if record.Verified {
+			return TrustVerified, nil
+		}
+		if record.Supersedes != "" {
+			return TrustChanged, nil
+		}
+		return TrustKnown, nil
+	}
+	status := TrustNew
+	supersedes := ""
+	for _, record := range t.records {
+		if record.Name == name && record.Fingerprint != fingerprint {
+			status = TrustChanged
+			supersedes = record.Fingerprint
+		}
+	}
+	t.records[id] = &TrustRecord{
+		Id:          id,
+		Name:        name,
+		Fingerprint: fingerprint,
+		FirstSeen:   time.Now().UTC(),
+		Supersedes:  supersedes,
+	}
+	return status, t.save()
+}
+
+func (t *TrustStore) SetVerified(id string, verified bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	record, found := t.records[id]
+	if !found {
+		return storage.ErrNotFound
+	}
+	record.Verified = verified
+	if verified {
+		record.Supersedes = ""
+	}
+	return t.save()
+}
+
+func (t *TrustStore) save() error {
+	data, err := json.Marshal(t.records)
+	if err != nil {
+		return err
+	}
+	return t.store.Put(trustRecord, data)
+}
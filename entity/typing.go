@@ -0,0 +1,52 @@
+package entity
+
+import (
+	"time"
+)
+
+const (
+	typingTimeout = 6 * time.Second
+)
+
+type TypingMessage struct {
+	Typing bool `json:"typing"`
+}
+
+func (o *Owner) SendTyping(peer *Room, typing bool) error {
+	if peer.IsGeneral || peer.IsGroup || !o.Settings.Get().TypingIndicators {
+		return nil
+	}
+	if peer.ConnState() != ConnConnected {
+		return nil
+	}
+	return o.sendSealed(peer, KindTyping, &TypingMessage{Typing: typing})
+}
+
+func (o *Owner) HandleTyping(peer *Room, env *Envelope) error {
+	m := &TypingMessage{}
+	if _, err := o.openSealed(peer, env, m); err != nil {
+		return err
+	}
+	peer.setTyping(m.Typing)
+	return nil
+}
+
+func (r *Room) setTyping(typing bool) {
+	r.presenceMutex.Lock()
+	was := time.Now().Before(r.typingUntil)
+	if typing {
+		r.typingUntil = time.Now().Add(typingTimeout)
+	} else {
+		r.typingUntil = time.Time{}
+	}
+	r.presenceMutex.Unlock()
+	if was != typing {
+		r.changed()
+	}
+}
+
+func (r *Room) IsTyping() bool {
+	r.presenceMutex.Lock()
+	defer r.presenceMutex.Unlock()
+	return time.Now().Before(r.typingUntil)
+}
@@ -6,6 +6,7 @@ require (
 	github.com/gdamore/tcell/v2 v2.6.0
 	github.com/google/uuid v1.3.0
 	github.com/rivo/tview v0.0.0-20230621164836-6cc0565babaf
+	golang.org/x/crypto v0.10.0
 	golang.org/x/net v0.11.0
 )
 
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"chat_tool/utils"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreRecord = "keystore.json"
+	keystoreCheck  = "chat_tool"
+	saltSize       = 16
+	keySize        = 32
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+	rekeySuffix    = ".rekey"
+	oldSuffix      = ".old"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("ErrorWrongPassphrase")
+	ErrEmptyPassphrase = errors.New("ErrorEmptyPassphrase")
+	ErrCorrupted       = errors.New("ErrorCorrupted")
+)
+
+type keystore struct {
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Check []byte `json:"check"`
+}
+
+func newKeystore() (*keystore, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &keystore{
+		Salt: salt,
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+	}, nil
+}
+
+func loadKeystore(dir string) (*keystore, error) {
+	data, err := os.ReadFile(filepath.Join(dir, keystoreRecord))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	ks := &keystore{}
+	if err := json.Unmarshal(data, ks); err != nil {
+		return nil, ErrCorrupted
+	}
+	return ks, nil
+}
+
+func (k *keystore) save(dir string) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, keystoreRecord), data)
+}
+
+func (k *keystore) derive(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	return scrypt.Key([]byte(passphrase), k.Salt, k.N, k.R, k.P, keySize)
+}
+
+func (k *keystore) init(passphrase string) ([]byte, error) {
+	key, err := k.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k.Check, err = utils.SealMessage(key, keystoreCheck, []byte(keystoreRecord))
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *keystore) unlock(passphrase string) ([]byte, error) {
+	key, err := k.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	check, err := utils.OpenMessage(key, k.Check, []byte(keystoreRecord))
+	if err != nil || check != keystoreCheck {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+func (s *Store) ChangePassphrase(passphrase string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ks, err := newKeystore()
+	if err != nil {
+		return err
+	}
+	key, err := ks.init(passphrase)
+	if err != nil {
+		return err
+	}
+
+	rekeyDir := s.dir + rekeySuffix
+	if err := os.RemoveAll(rekeyDir); err != nil {
+		return err
+	}
+	next := &Store{dir: rekeyDir, key: key}
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == keystoreRecord || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		records, err := s.readRecords(name)
+		if err != nil {
+			return err
+		}
+		return next.putRecords(name, records)
+	})
+	if err == nil {
+		err = ks.save(rekeyDir)
+	}
+	if err != nil {
+		os.RemoveAll(rekeyDir)
+		return err
+	}
+
+	if err := os.Rename(s.dir, s.dir+oldSuffix); err != nil {
+		os.RemoveAll(rekeyDir)
+		return err
+	}
+	if err := os.Rename(rekeyDir, s.dir); err != nil {
+		return err
+	}
+	s.key = key
+	return os.RemoveAll(s.dir + oldSuffix)
+}
+
+func recoverRekey(dir string) error {
+	oldDir, rekeyDir := dir+oldSuffix, dir+rekeySuffix
+	if _, err := os.Stat(oldDir); err == nil {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if err := os.Rename(rekeyDir, dir); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(oldDir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(rekeyDir)
+}
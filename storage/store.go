@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"chat_tool/utils"
+)
+
+const (
+	homeEnv    = "CHAT_TOOL_HOME"
+	defaultDir = ".chat_tool"
+	dirPerm    = 0o700
+	filePerm   = 0o600
+)
+
+var (
+	ErrNotFound = errors.New("ErrorNotFound")
+)
+
+type Store struct {
+	mutex sync.Mutex
+	dir   string
+	key   []byte
+}
+
+func DefaultDir() (string, error) {
+	if dir := os.Getenv(homeEnv); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, defaultDir), nil
+}
+
+func Open(dir, passphrase string) (*Store, error) {
+	if err := recoverRekey(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, err
+	}
+	ks, err := loadKeystore(dir)
+	if errors.Is(err, ErrNotFound) {
+		ks, err = newKeystore()
+		if err != nil {
+			return nil, err
+		}
+		key, err := ks.init(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if err := ks.save(dir); err != nil {
+			return nil, err
+		}
+		return &Store{dir: dir, key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := ks.unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir: dir,
+		key: key,
+	}, nil
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *Store) seal(name string, data []byte) ([]byte, error) {
+	sealed, err := utils.SealMessage(s.key, string(data), []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+func (s *Store) open(name string, line []byte) ([]byte, error) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, &utils.DecryptError{Err: err}
+	}
+	data, err := utils.OpenMessage(s.key, sealed[:n], []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (s *Store) Get(name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records, err := s.readRecords(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 1 {
+		return nil, ErrCorrupted
+	}
+	return records[0], nil
+}
+
+func (s *Store) Put(name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.putRecords(name, [][]byte{data})
+}
+
+func (s *Store) Append(name string, record []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	line, err := s.seal(name, record)
+	if err != nil {
+		return err
+	}
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Store) ReadRecords(name string) ([][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.readRecords(name)
+}
+
+func (s *Store) PutRecords(name string, records [][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.putRecords(name, records)
+}
+
+func (s *Store) readRecords(name string) ([][]byte, error) {
+	lines, err := readLines(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	records := make([][]byte, 0, len(lines))
+	corrupted := false
+	for _, line := range lines {
+		record, err := s.open(name, line)
+		if err != nil {
+			corrupted = true
+			continue
+		}
+		records = append(records, record)
+	}
+	if corrupted {
+		return records, ErrCorrupted
+	}
+	return records, nil
+}
+
+func (s *Store) putRecords(name string, records [][]byte) error {
+	lines := make([][]byte, 0, len(records))
+	for _, record := range records {
+		line, err := s.seal(name, record)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	return writeLines(s.path(name), lines)
+}
+
+func readLines(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := make([][]byte, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+	return lines, scanner.Err()
+}
+
+func writeLines(path string, lines [][]byte) error {
+	data := make([]byte, 0)
+	for _, line := range lines {
+		data = append(append(data, line...), '\n')
+	}
+	return writeFile(path, data)
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), filePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestChangePassphraseKeepsCorruptedRecords(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"first", "second"} {
+		if err := s.Append("history/room.log", []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := s.path("history/room.log")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0x01
+	if err := os.WriteFile(path, data, filePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ChangePassphrase("new"); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("ChangePassphrase = %v, want ErrCorrupted", err)
+	}
+	reopened, err := Open(dir, "old")
+	if err != nil {
+		t.Fatalf("old passphrase no longer opens the store: %v", err)
+	}
+	records, err := reopened.ReadRecords("history/room.log")
+	if !errors.Is(err, ErrCorrupted) || len(records) != 1 || string(records[0]) != "second" {
+		t.Fatalf("ReadRecords = %q, %v", records, err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil || string(after) != string(data) {
+		t.Fatal("corrupted record was rewritten")
+	}
+}
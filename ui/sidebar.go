@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/rivo/tview"
 
@@ -9,9 +10,9 @@ import (
 )
 
 type Sidebar struct {
-	View         *tview.List
-	repo         *entity.RoomRepository
-	currentCount int
+	View    *tview.List
+	repo    *entity.RoomRepository
+	current string
 }
 
 func NewSidebar(repo *entity.RoomRepository) *Sidebar {
@@ -20,24 +21,85 @@ func NewSidebar(repo *entity.RoomRepository) *Sidebar {
 		SetBorder(true)
 	view.SetWrapAround(true)
 	return &Sidebar{
-		View:         view,
-		repo:         repo,
-		currentCount: -1,
+		View: view,
+		repo: repo,
 	}
 }
 
 func (s *Sidebar) Reprint() {
-	count := len(s.repo.GetRooms())
-	if s.currentCount == count {
+	rooms := s.repo.GetRooms()
+	texts := make([]string, 0, len(rooms))
+	keys := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		texts = append(texts, formatRoom(room))
+		keys = append(keys, room.Id+texts[len(texts)-1])
+	}
+	current := strings.Join(keys, "\n")
+	if s.current == current {
 		return
 	}
-	s.currentCount = count
+	s.current = current
+	selected := s.View.GetCurrentItem()
 	s.View.Clear()
-	for _, room := range s.repo.GetRooms() {
-		mainText := fmt.Sprintf("%s (Addr: %s)", room.Name, room.Host)
-		if room.IsGeneral {
-			mainText = room.Name
-		}
-		s.View.AddItem(mainText, room.Id, 0, nil)
+	for i, room := range rooms {
+		s.View.AddItem(texts[i], room.Id, 0, nil)
+	}
+	if selected < len(rooms) {
+		s.View.SetCurrentItem(selected)
+	}
+}
+
+func formatRoom(room *entity.Room) string {
+	name, members := room.Info()
+	name = tview.Escape(name)
+	presence, status := room.Presence()
+	mainText := fmt.Sprintf("%s%s%s (Addr: %s)%s%s", name, formatPresence(presence), formatTrust(room.Trust), room.Addr(), formatConnState(room.ConnState()), formatStatus(status))
+	if room.IsGeneral {
+		mainText = name
+	}
+	if room.IsGroup {
+		mainText = fmt.Sprintf("%s (Group: %d members)", name, len(members))
+	}
+	return mainText
+}
+
+func formatPresence(presence entity.Presence) string {
+	switch presence {
+	case entity.PresenceAway:
+		return " [yellow]away[white]"
+	case entity.PresenceBusy:
+		return " [red]busy[white]"
+	case entity.PresenceInvisible:
+		return " [gray]offline[white]"
+	}
+	return " [green]online[white]"
+}
+
+func formatStatus(status string) string {
+	if status == "" {
+		return ""
+	}
+	return fmt.Sprintf(" [gray]%s[white]", tview.Escape(status))
+}
+
+func formatTrust(status entity.TrustStatus) string {
+	switch status {
+	case entity.TrustVerified:
+		return " [green]✔[white]"
+	case entity.TrustChanged:
+		return " [red]⚠ KEY CHANGED[white]"
+	}
+	return ""
+}
+
+func formatConnState(state entity.ConnState) string {
+	switch state {
+	case entity.ConnConnecting:
+		return " [yellow]connecting…[white]"
+	case entity.ConnConnected:
+		return " [green]●[white]"
+	case entity.ConnBackingOff:
+		return " [red]reconnecting…[white]"
 	}
+	return ""
 }
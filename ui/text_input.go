@@ -1,20 +1,84 @@
 package ui
 
 import (
+	"sync"
+	"time"
+
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
+
+	"chat_tool/entity"
+	"chat_tool/utils"
+)
+
+const (
+	typingThrottle = 3 * time.Second
+	typingIdle     = 4 * time.Second
 )
 
 type TextInput struct {
-	View *tview.InputField
+	View   *tview.InputField
+	typing *typingNotifier
 }
 
-func NewTextInput() *TextInput {
+func NewTextInput(owner *entity.Owner) *TextInput {
 	inputField := tview.NewInputField().
 		SetPlaceholder("Type a new message").
 		SetDoneFunc(func(key tcell.Key) {})
 	inputField.SetBorder(true)
 	return &TextInput{
-		View: inputField,
+		View:   inputField,
+		typing: &typingNotifier{owner: owner},
+	}
+}
+
+type typingNotifier struct {
+	mutex    sync.Mutex
+	owner    *entity.Owner
+	room     *entity.Room
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+func (t *typingNotifier) Changed(room *entity.Room, text string) {
+	if room == nil || text == "" {
+		t.Stop()
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.room != nil && t.room != room {
+		t.send(t.room, false)
+		t.lastSent = time.Time{}
+	}
+	t.room = room
+	if time.Since(t.lastSent) >= typingThrottle {
+		t.lastSent = time.Now()
+		t.send(room, true)
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(typingIdle, t.Stop)
+}
+
+func (t *typingNotifier) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if t.room == nil {
+		return
+	}
+	t.send(t.room, false)
+	t.room = nil
+	t.lastSent = time.Time{}
+}
+
+func (t *typingNotifier) send(room *entity.Room, typing bool) {
+	if err := t.owner.SendTyping(room, typing); err != nil {
+		utils.LL.Warn("Typing: %s", err.Error())
 	}
 }
@@ -4,41 +4,229 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 
 	"chat_tool/entity"
 )
 
 type TextView struct {
-	View                *tview.TextView
-	currentMessageCount int
+	View     *tview.TextView
+	current  *entity.MessageStore
+	version  uint64
+	ids      []string
+	rendered []renderedMessage
+	selected string
+	drawn    bool
+}
+
+type renderedMessage struct {
+	id    string
+	lines []string
 }
 
 func NewTextView() *TextView {
 	messages := tview.NewTextView().
 		SetText("").
 		SetDynamicColors(true).
+		SetRegions(true).
 		SetScrollable(true)
 	messages.SetBorder(true)
-	return &TextView{
-		View:                messages,
-		currentMessageCount: 0,
+	c := &TextView{
+		View: messages,
 	}
+	messages.SetDrawFunc(func(screen tcell.Screen, x, y, width, height int) (int, int, int, int) {
+		c.drawn = true
+		return messages.GetInnerRect()
+	})
+	messages.SetHighlightedFunc(func(added, removed, remaining []string) {
+		if len(added) > 0 {
+			c.selected = added[0]
+		} else if len(remaining) == 0 {
+			c.selected = ""
+		}
+	})
+	return c
 }
 
-func (c *TextView) RenderMessages(messages []*entity.ChatMessage, selfName string) {
-	if c.currentMessageCount == len(messages) {
+func (c *TextView) RenderMessages(messages *entity.MessageStore, selfName string) {
+	version := messages.Version()
+	if c.current == messages && c.version == version {
 		return
 	}
-	c.currentMessageCount = len(messages)
+	if c.current != messages {
+		c.ClearSelection()
+	}
+	c.current = messages
+	c.version = version
+	c.ids = c.ids[:0]
+	c.rendered = c.rendered[:0]
 	text := strings.Repeat("\n", maxMessagesInView)
-	for _, message := range messages {
-		text += fmt.Sprintf("%s %s: %s\n\n",
-			formatTime(message),
-			formatAuthor(message, message.Author == selfName),
-			formatText(message))
+	parents := make(map[string]entity.ChatMessage)
+	messages.Range(func(message entity.ChatMessage) bool {
+		line := formatMessage(&message, selfName)
+		if message.ParentId != "" {
+			line = formatQuote(parents, message.ParentId) + line
+		}
+		c.rendered = append(c.rendered, renderedMessage{message.Id, strings.Split(line, "\n")})
+		if message.Id != "" {
+			parents[message.Id] = message
+			c.ids = append(c.ids, message.Id)
+			line = fmt.Sprintf(`["%s"]%s[""]`, message.Id, line)
+		}
+		text += line + "\n\n"
+		return true
+	})
+	c.View.SetText(text[:len(text)-1])
+	if c.selected == "" {
+		c.scrollToEnd()
+	}
+}
+
+func (c *TextView) Visible() []string {
+	_, _, width, height := c.View.GetInnerRect()
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	bottom := maxMessagesInView
+	spans := make([][2]int, len(c.rendered))
+	for i, message := range c.rendered {
+		spans[i][0] = bottom
+		for _, line := range message.lines {
+			if rows := (tview.TaggedStringWidth(line) + width - 1) / width; rows > 1 {
+				bottom += rows
+			} else {
+				bottom++
+			}
+		}
+		spans[i][1] = bottom
+		bottom++
+	}
+	top, _ := c.View.GetScrollOffset()
+	if !c.drawn {
+		if c.selected != "" {
+			return nil
+		}
+		top = bottom - height
+	}
+	visible := make([]string, 0)
+	for i, message := range c.rendered {
+		if message.id != "" && spans[i][0] < top+height && spans[i][1] > top {
+			visible = append(visible, message.id)
+		}
+	}
+	return visible
+}
+
+func (c *TextView) Selected() string {
+	return c.selected
+}
+
+func (c *TextView) Select(delta int) {
+	if len(c.ids) == 0 {
+		return
+	}
+	index := len(c.ids)
+	for i, id := range c.ids {
+		if id == c.selected {
+			index = i
+			break
+		}
+	}
+	index += delta
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(c.ids) {
+		c.ClearSelection()
+		return
+	}
+	c.View.Highlight(c.ids[index]).ScrollToHighlight()
+	c.drawn = false
+}
+
+func (c *TextView) ClearSelection() {
+	c.selected = ""
+	c.View.Highlight()
+	c.scrollToEnd()
+}
+
+func (c *TextView) scrollToEnd() {
+	c.View.ScrollToEnd()
+	c.drawn = false
+}
+
+func RenderThread(messages *entity.MessageStore, id, selfName string) string {
+	all := make([]entity.ChatMessage, 0, messages.Len())
+	byId := make(map[string]entity.ChatMessage)
+	messages.Range(func(message entity.ChatMessage) bool {
+		all = append(all, message)
+		if message.Id != "" {
+			byId[message.Id] = message
+		}
+		return true
+	})
+	depth := func(message entity.ChatMessage) (string, int) {
+		root, d := message.Id, 0
+		for parent, found := byId[message.ParentId]; found && d < len(all); parent, found = byId[parent.ParentId] {
+			root, d = parent.Id, d+1
+		}
+		return root, d
+	}
+	root, _ := depth(byId[id])
+	text := ""
+	for _, message := range all {
+		if message.Id == "" {
+			continue
+		}
+		if r, d := depth(message); r == root {
+			text += fmt.Sprintf("%s%s\n\n", strings.Repeat("  ", d), formatMessage(&message, selfName))
+		}
+	}
+	return text
+}
+
+func formatMessage(message *entity.ChatMessage, selfName string) string {
+	return fmt.Sprintf("%s %s: %s%s%s",
+		formatTime(message),
+		formatAuthor(message, message.Author == selfName),
+		formatText(message),
+		formatState(message),
+		formatReactions(message))
+}
+
+func formatReactions(message *entity.ChatMessage) string {
+	if len(message.Reactions) == 0 {
+		return ""
+	}
+	emojis := make([]string, 0)
+	users := make(map[string][]string)
+	for _, reaction := range message.Reactions {
+		if _, found := users[reaction.Emoji]; !found {
+			emojis = append(emojis, reaction.Emoji)
+		}
+		users[reaction.Emoji] = append(users[reaction.Emoji], reaction.User)
 	}
-	c.View.SetText(text[:len(text)-1]).ScrollToEnd()
+	text := ""
+	for _, emoji := range emojis {
+		text += fmt.Sprintf(" [yellow]%s %d [gray](%s)", tview.Escape(emoji), len(users[emoji]), tview.Escape(strings.Join(users[emoji], ", ")))
+	}
+	return "\n" + text[1:]
+}
+
+func formatQuote(parents map[string]entity.ChatMessage, parentId string) string {
+	parent, found := parents[parentId]
+	if !found {
+		return "[gray]↳ reply to an earlier message\n"
+	}
+	content := parent.Content
+	if parent.Deleted {
+		content = "message deleted"
+	}
+	if runes := []rune(content); len(runes) > maxQuoteLength {
+		content = string(runes[:maxQuoteLength]) + "…"
+	}
+	return fmt.Sprintf("[gray]↳ %s: %s\n", tview.Escape(parent.Author), tview.Escape(content))
 }
 
 func formatTime(message *entity.ChatMessage) string {
@@ -48,11 +236,33 @@ func formatTime(message *entity.ChatMessage) string {
 
 func formatAuthor(message *entity.ChatMessage, isAuthor bool) string {
 	if isAuthor {
-		return fmt.Sprintf("%s%s", "[green]", message.Author)
+		return fmt.Sprintf("%s%s", "[green]", tview.Escape(message.Author))
 	}
-	return fmt.Sprintf("%s%s", "[red]", message.Author)
+	return fmt.Sprintf("%s%s", "[red]", tview.Escape(message.Author))
 }
 
 func formatText(message *entity.ChatMessage) string {
-	return fmt.Sprintf("%s%s", "[white]", message.Content)
+	if message.Deleted {
+		return "[gray::i]message deleted[-:-:-]"
+	}
+	if message.Edited {
+		return fmt.Sprintf("%s%s [gray](edited)", "[white]", tview.Escape(message.Content))
+	}
+	return fmt.Sprintf("%s%s", "[white]", tview.Escape(message.Content))
+}
+
+func formatState(message *entity.ChatMessage) string {
+	switch message.State {
+	case entity.DeliveryPending:
+		return " [gray]…"
+	case entity.DeliverySent:
+		return " [gray]✓"
+	case entity.DeliveryDelivered:
+		return " [green]✓✓"
+	case entity.DeliveryFailed:
+		return " [red]✗ failed"
+	case entity.DeliverySeen:
+		return " [blue]✓✓ seen"
+	}
+	return ""
 }
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"chat_tool/connection"
 	"chat_tool/entity"
+	"chat_tool/storage"
 	"chat_tool/utils"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"image/jpeg"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -21,25 +24,45 @@ import (
 const (
 	defaultPort        = "25042"
 	defaultBroadcastIP = "224.0.0.1"
-	reprintFrequency   = 50 * time.Millisecond
+	clockFrequency     = time.Second
+	shutdownTimeout    = 3 * time.Second
 	timeFormat         = time.RFC3339
 	maxMessagesInView  = 10000
+	maxQuoteLength     = 60
 	CHAT_PAGE          = "CHAT_PAGE"
 	LOG_PAGE           = "LOG_PAGE"
+	VERIFY_PAGE        = "VERIFY_PAGE"
+	GROUP_PAGE         = "GROUP_PAGE"
+	PRESENCE_PAGE      = "PRESENCE_PAGE"
+	SETTINGS_PAGE      = "SETTINGS_PAGE"
+	THREAD_PAGE        = "THREAD_PAGE"
+	REACTION_PAGE      = "REACTION_PAGE"
+	autoAwayAfter      = 5 * time.Minute
+	readReceiptWindow  = 10 * time.Second
 )
 
 type App struct {
-	broadcastIP string
-	owner       *entity.Owner
-	loggerView  *LoggerView
-	textInput   *TextInput
-	textView    *TextView
-	sidebar     *Sidebar
-	view        *tview.Flex
-	ui          *tview.Application
-	pages       *tview.Pages
-	currentRoom *entity.Room
-	currentView int
+	broadcastIP     string
+	realm           *utils.Realm
+	liveness        entity.Liveness
+	owner           *entity.Owner
+	loggerView      *LoggerView
+	textInput       *TextInput
+	textView        *TextView
+	sidebar         *Sidebar
+	view            *tview.Flex
+	ui              *tview.Application
+	pages           *tview.Pages
+	currentRoom     *entity.Room
+	unsubscribeRoom func()
+	currentView     int
+	editing         string
+	replying        string
+	redraw          chan struct{}
+	lastInput       time.Time
+	autoAway        bool
+	logMutex        sync.Mutex
+	pendingLogs     []string
 }
 
 func checkInputPort(textToCheck string, lastChar rune) bool {
@@ -49,23 +72,34 @@ func checkInputPort(textToCheck string, lastChar rune) bool {
 	return true
 }
 
-func NewApp(broadcastChanBuffer int) *App {
+func modal(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
+
+func NewApp(broadcastChanBuffer int, retention entity.Retention, liveness entity.Liveness) *App {
 	title := ""
 	yourName := ""
 	localPort := defaultPort
 	broadcastIP := defaultBroadcastIP
+	passphrase := ""
+	newPassphrase := ""
+	confirmPassphrase := ""
+	networkPassphrase := ""
+	var store *storage.Store
 
-	appInfo := tview.NewApplication()
-	modal := func(p tview.Primitive, width, height int) tview.Primitive {
-		return tview.NewFlex().
-			AddItem(nil, 0, 1, false).
-			AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
-				AddItem(nil, 0, 1, false).
-				AddItem(p, height, 1, true).
-				AddItem(nil, 0, 1, false), width, 1, true).
-			AddItem(nil, 0, 1, false)
+	dir, err := storage.DefaultDir()
+	if err != nil {
+		panic(err)
 	}
 
+	appInfo := tview.NewApplication()
+
 	background := tview.NewImage()
 	background.SetColors(tview.TrueColor)
 
@@ -93,11 +127,40 @@ func NewApp(broadcastChanBuffer int) *App {
 				localPort = defaultPort
 			}
 		}).
-		AddButton("☻ FANTASY REALM ☻", func() {
-			if yourName != "" && title != "" {
-				appInfo.Stop()
-			}
+		AddPasswordField("Passphrase", "", 20, '*', func(text string) {
+			passphrase = text
+		}).
+		AddPasswordField("New passphrase", "", 20, '*', func(text string) {
+			newPassphrase = text
+		}).
+		AddPasswordField("Confirm new passphrase", "", 20, '*', func(text string) {
+			confirmPassphrase = text
+		}).
+		AddPasswordField("Network passphrase", "", 20, '*', func(text string) {
+			networkPassphrase = text
 		})
+	form.AddButton("☻ FANTASY REALM ☻", func() {
+		if yourName == "" || title == "" {
+			return
+		}
+		if newPassphrase != confirmPassphrase {
+			form.SetTitle("Information - [red]new passphrases do not match")
+			return
+		}
+		s, err := storage.Open(dir, passphrase)
+		if err != nil {
+			form.SetTitle(fmt.Sprintf("Information - [red]%s", formatStorageError(err)))
+			return
+		}
+		if newPassphrase != "" {
+			if err := s.ChangePassphrase(newPassphrase); err != nil {
+				form.SetTitle(fmt.Sprintf("Information - [red]%s", formatStorageError(err)))
+				return
+			}
+		}
+		store = s
+		appInfo.Stop()
+	})
 	form.SetButtonBackgroundColor(tcell.ColorRed).
 		SetButtonsAlign(tview.AlignCenter)
 	form.SetBorder(true)
@@ -105,20 +168,27 @@ func NewApp(broadcastChanBuffer int) *App {
 
 	pages := tview.NewPages().
 		AddPage("background", background, true, true).
-		AddPage("modal", modal(form, 55, 13), true, true)
+		AddPage("modal", modal(form, 55, 21), true, true)
 
 	if err := appInfo.SetRoot(pages, true).Run(); err != nil {
 		panic(err)
 	}
 
-	if yourName == "" || title == "" {
+	if yourName == "" || title == "" || store == nil {
 		panic("exits")
 	}
-	p := entity.NewOwner(fmt.Sprintf("%s (%s)", yourName, title), localPort, broadcastChanBuffer)
+	realm, err := utils.NewRealm(networkPassphrase)
+	if err != nil {
+		panic(err)
+	}
+	p, err := entity.NewOwner(fmt.Sprintf("%s (%s)", yourName, title), localPort, broadcastChanBuffer, store, retention)
+	if err != nil {
+		panic(err)
+	}
 	appChat := &App{
 		owner:       p,
 		loggerView:  NewLoggerView(),
-		textInput:   NewTextInput(),
+		textInput:   NewTextInput(p),
 		textView:    NewTextView(),
 		sidebar:     NewSidebar(p.Repo),
 		view:        tview.NewFlex(),
@@ -127,33 +197,41 @@ func NewApp(broadcastChanBuffer int) *App {
 		currentRoom: nil,
 		currentView: 0,
 		broadcastIP: broadcastIP,
+		realm:       realm,
+		liveness:    liveness,
+		redraw:      make(chan struct{}, 1),
+		lastInput:   time.Now(),
 	}
 	appChat.initView()
 	appChat.initBindings()
-	appChat.run()
 	return appChat
 }
 
-func (app *App) Run(ctx context.Context, version string) error {
-	if c := connection.NewBroker(app.owner, app.broadcastIP); c != nil {
-		c.Start(ctx)
+func formatStorageError(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrWrongPassphrase):
+		return "wrong passphrase"
+	case errors.Is(err, storage.ErrEmptyPassphrase):
+		return "passphrase required"
+	case errors.Is(err, storage.ErrCorrupted):
+		return "storage has unreadable records"
 	}
+	return err.Error()
+}
 
-	go func() {
-		for {
-			removeid, ok := <-app.owner.Repo.Updated
-			if !ok {
-				return
-			}
-			if removeid == app.currentRoom.Id {
-				app.currentRoom = nil
-			}
-		}
-	}()
+func (app *App) Run(ctx context.Context, version string) error {
+	go utils.LL.Exec(ctx, app.appendLog)
+	app.run(ctx)
 
-	go utils.LL.Exec(ctx, func(s string) {
-		app.loggerView.RenderMessages(s)
-	})
+	broker := connection.NewBroker(app.owner, app.broadcastIP, app.realm, app.liveness)
+	if broker != nil {
+		broker.Start(ctx)
+		defer func() {
+			ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+			defer cancel()
+			broker.Stop(ctx)
+		}()
+	}
 
 	frameChat := tview.NewFrame(app.view).
 		SetBorders(1, 1, 1, 1, 2, 2).
@@ -184,6 +262,16 @@ func (app *App) initView() {
 }
 
 func (app *App) initBindings() {
+	app.ui.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		app.markActive()
+		return event
+	})
+	app.ui.SetMouseCapture(func(event *tcell.EventMouse, action tview.MouseAction) (*tcell.EventMouse, tview.MouseAction) {
+		if action != tview.MouseMove {
+			app.markActive()
+		}
+		return event, action
+	})
 	app.view.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Key() == tcell.KeyLeft {
 			app.pages.SwitchToPage(LOG_PAGE)
@@ -200,7 +288,7 @@ func (app *App) initBindings() {
 	app.sidebar.View.SetMouseCapture(func(action tview.MouseAction, event *tcell.EventMouse) (tview.MouseAction, *tcell.EventMouse) {
 		if action == tview.MouseLeftDoubleClick {
 			if app.sidebar.View.GetItemCount() > 0 {
-				app.currentRoom = app.getCurrentRoom()
+				app.openRoom(app.getCurrentRoom())
 			}
 		}
 		return action, event
@@ -209,25 +297,112 @@ func (app *App) initBindings() {
 	app.sidebar.View.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Key() == tcell.KeyEnter {
 			if app.sidebar.View.GetItemCount() > 0 {
-				app.currentRoom = app.getCurrentRoom()
+				app.openRoom(app.getCurrentRoom())
 			}
 		}
-		return event
+		if event.Key() != tcell.KeyRune {
+			return event
+		}
+		switch event.Rune() {
+		case 'v':
+			if room := app.getCurrentRoom(); room != nil && !room.IsGeneral && !room.IsGroup {
+				app.showVerification(room)
+			}
+		case 'g':
+			app.showCreateGroup()
+		case 'l':
+			if room := app.getCurrentRoom(); room != nil && room.IsGroup {
+				app.owner.LeaveGroup(room)
+				if app.currentRoom == room {
+					app.setCurrentRoom(nil)
+				}
+			}
+		case 'x':
+			if room := app.getCurrentRoom(); room != nil && room.IsGroup {
+				app.showRemoveMember(room)
+			}
+		case 'p':
+			app.showPresence()
+		case 's':
+			app.showSettings()
+		default:
+			return event
+		}
+		return nil
+	})
+
+	app.textInput.View.SetChangedFunc(func(text string) {
+		app.textInput.typing.Changed(app.currentRoom, text)
+	})
+	app.textView.View.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp:
+			app.textView.Select(-1)
+			return nil
+		case tcell.KeyDown:
+			app.textView.Select(1)
+			return nil
+		case tcell.KeyEscape:
+			app.textView.ClearSelection()
+			app.ui.SetFocus(app.textInput.View)
+			return nil
+		case tcell.KeyRune:
+		default:
+			return event
+		}
+		switch event.Rune() {
+		case 'e':
+			app.startEdit()
+		case 'd':
+			app.deleteSelected()
+		case 'r':
+			app.startReply()
+		case 't':
+			app.showThread()
+		case 'a':
+			app.showReactions()
+		default:
+			return event
+		}
+		return nil
 	})
 
 	app.textInput.View.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyUp && app.textInput.View.GetText() == "" && app.currentRoom != nil {
+			app.textView.Select(-1)
+			app.ui.SetFocus(app.textView.View)
+			return nil
+		}
+		if event.Key() == tcell.KeyEscape && (app.editing != "" || app.replying != "") {
+			app.cancelEdit()
+			return nil
+		}
 		if event.Key() == tcell.KeyEnter {
 			if app.currentRoom == nil || app.textInput.View.GetText() == "" {
 				return event
 			}
 			message := app.textInput.View.GetText()
+			if app.editing != "" {
+				if err := app.owner.EditMessage(app.currentRoom, app.editing, message); err != nil {
+					utils.LL.Error("EditMessage: %s", err.Error())
+				}
+				app.cancelEdit()
+				return event
+			}
 			peer := app.currentRoom
-			app.currentRoom.AddMessage(message, app.owner.Name)
-			if err := peer.SendMessage(app.owner.Id, message, app.owner.DH); err != nil {
+			m := app.currentRoom.AddReply(message, app.replying, app.owner.Id, app.owner.Name)
+			app.cancelEdit()
+			if err := app.owner.SendMessage(peer, m); err != nil {
 				utils.LL.Error("SendMessage: %s", err.Error())
-				app.owner.Repo.Delete(peer.Id)
+				if peer.IsGeneral {
+					app.textInput.View.SetText("")
+					return event
+				}
+				if !peer.IsGroup {
+					app.owner.Repo.Delete(peer.Id)
+				}
 				app.textView.View.SetText("")
-				app.currentRoom = nil
+				app.setCurrentRoom(nil)
 				app.ui.SetFocus(app.sidebar.View)
 			}
 			app.textInput.View.SetText("")
@@ -236,14 +411,349 @@ func (app *App) initBindings() {
 	})
 }
 
+func (app *App) openRoom(room *entity.Room) {
+	app.setCurrentRoom(room)
+	app.renderMessages()
+}
+
+func (app *App) setCurrentRoom(room *entity.Room) {
+	if room == app.currentRoom {
+		return
+	}
+	app.cancelEdit()
+	if app.unsubscribeRoom != nil {
+		app.unsubscribeRoom()
+		app.unsubscribeRoom = nil
+	}
+	app.currentRoom = room
+	if room != nil {
+		app.unsubscribeRoom = room.Messages.Subscribe(func(entity.ChatMessage) {
+			app.notify()
+		})
+	}
+}
+
+func (app *App) selectedMessage() (entity.ChatMessage, bool) {
+	if app.currentRoom == nil || app.textView.Selected() == "" {
+		return entity.ChatMessage{}, false
+	}
+	m, found := app.currentRoom.Messages.Get(app.textView.Selected())
+	if !found || m.Deleted || m.AuthorId != app.owner.Id {
+		return entity.ChatMessage{}, false
+	}
+	return m, true
+}
+
+func (app *App) startEdit() {
+	m, ok := app.selectedMessage()
+	if !ok {
+		return
+	}
+	app.editing = m.Id
+	app.textInput.View.SetLabel("Edit: ").SetText(m.Content)
+	app.ui.SetFocus(app.textInput.View)
+}
+
+func (app *App) startReply() {
+	if app.currentRoom == nil || app.textView.Selected() == "" {
+		return
+	}
+	m, found := app.currentRoom.Messages.Get(app.textView.Selected())
+	if !found {
+		return
+	}
+	app.editing = ""
+	app.replying = m.Id
+	app.textInput.View.SetLabel(fmt.Sprintf("Reply to %s: ", m.Author)).SetText("")
+	app.ui.SetFocus(app.textInput.View)
+}
+
+func (app *App) showThread() {
+	if app.currentRoom == nil || app.textView.Selected() == "" {
+		return
+	}
+	thread := tview.NewTextView().
+		SetDynamicColors(true).
+		SetScrollable(true).
+		SetText(RenderThread(app.currentRoom.Messages, app.textView.Selected(), app.owner.Name))
+	thread.SetDoneFunc(func(key tcell.Key) {
+		app.closeModal(THREAD_PAGE)
+	})
+	thread.SetBorder(true).SetTitle("Thread")
+	app.pages.AddPage(THREAD_PAGE, modal(thread, 100, 25), true, true)
+	app.ui.SetFocus(thread)
+}
+
+func (app *App) showReactions() {
+	if app.currentRoom == nil || app.textView.Selected() == "" {
+		return
+	}
+	room := app.currentRoom
+	m, found := room.Messages.Get(app.textView.Selected())
+	if !found || m.Deleted {
+		return
+	}
+	list := tview.NewList().ShowSecondaryText(false)
+	for _, emoji := range entity.Emojis {
+		emoji := emoji
+		text := emoji
+		if m.HasReaction(app.owner.Id, emoji) {
+			text += " [green]✓"
+		}
+		list.AddItem(text, "", 0, func() {
+			if err := app.owner.ToggleReaction(room, m.Id, emoji); err != nil {
+				utils.LL.Error("ToggleReaction: %s", err.Error())
+			}
+			app.closeModal(REACTION_PAGE)
+		})
+	}
+	list.SetDoneFunc(func() {
+		app.closeModal(REACTION_PAGE)
+	})
+	list.SetBorder(true).SetTitle("React")
+	app.pages.AddPage(REACTION_PAGE, modal(list, 20, len(entity.Emojis)+2), true, true)
+	app.ui.SetFocus(list)
+}
+
+func (app *App) cancelEdit() {
+	if app.editing == "" && app.replying == "" {
+		return
+	}
+	app.editing, app.replying = "", ""
+	app.textInput.View.SetLabel("").SetText("")
+	app.textView.ClearSelection()
+}
+
+func (app *App) deleteSelected() {
+	m, ok := app.selectedMessage()
+	if !ok {
+		return
+	}
+	if err := app.owner.DeleteMessage(app.currentRoom, m.Id); err != nil {
+		utils.LL.Error("DeleteMessage: %s", err.Error())
+	}
+}
+
+func (app *App) showVerification(room *entity.Room) {
+	action := "Mark verified"
+	if room.Trust == entity.TrustVerified {
+		action = "Unverify"
+	}
+	text := fmt.Sprintf("Safety number with %s\n\n%s\n\nTheir fingerprint\n%s\n\nYour fingerprint\n%s\n\nCompare the safety number out loud before verifying.",
+		room.Name,
+		app.owner.SafetyNumber(room),
+		utils.Fingerprint(room.IdentityKey),
+		utils.Fingerprint(app.owner.Identity.PublicKey))
+	if room.Trust == entity.TrustChanged {
+		text = "WARNING: this peer's key differs from the one seen before.\n\n" + text
+	}
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{action, "Close"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			if buttonLabel == action {
+				if err := app.owner.SetVerified(room, room.Trust != entity.TrustVerified); err != nil {
+					utils.LL.Error("Verify: %s", err.Error())
+				}
+			}
+			app.closeModal(VERIFY_PAGE)
+		})
+	app.pages.AddPage(VERIFY_PAGE, modal, true, true)
+	app.ui.SetFocus(modal)
+}
+
+func (app *App) closeModal(page string) {
+	app.pages.RemovePage(page)
+	app.ui.SetFocus(app.sidebar.View)
+}
+
+func (app *App) showCreateGroup() {
+	name := ""
+	selected := make(map[string]bool)
+	form := tview.NewForm().
+		AddInputField("Group name", "", 20, nil, func(text string) {
+			name = strings.TrimSpace(text)
+		})
+	peers := 0
+	for _, room := range app.owner.Repo.GetRooms() {
+		if room.IsGeneral || room.IsGroup {
+			continue
+		}
+		id := room.Id
+		peers++
+		form.AddCheckbox(room.Name, false, func(checked bool) {
+			selected[id] = checked
+		})
+	}
+	form.AddButton("Create", func() {
+		members := make([]string, 0, len(selected))
+		for id, checked := range selected {
+			if checked {
+				members = append(members, id)
+			}
+		}
+		if name == "" || len(members) == 0 {
+			return
+		}
+		if _, err := app.owner.CreateGroup(name, members); err != nil {
+			utils.LL.Error("CreateGroup: %s", err.Error())
+		}
+		app.closeModal(GROUP_PAGE)
+	}).AddButton("Cancel", func() {
+		app.closeModal(GROUP_PAGE)
+	})
+	form.SetBorder(true).SetTitle("New group")
+	app.pages.AddPage(GROUP_PAGE, modal(form, 55, 7+2*peers), true, true)
+	app.ui.SetFocus(form)
+}
+
+func (app *App) showRemoveMember(group *entity.Room) {
+	groupName, members := group.Info()
+	names := make([]string, 0, len(members))
+	ids := make([]string, 0, len(members))
+	for _, id := range members {
+		if id == app.owner.Id {
+			continue
+		}
+		name := id
+		if peer, found := app.owner.Repo.Get(id); found {
+			name = peer.Name
+		}
+		names = append(names, name)
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	index := 0
+	form := tview.NewForm().
+		AddDropDown("Member", names, 0, func(option string, optionIndex int) {
+			index = optionIndex
+		}).
+		AddButton("Remove", func() {
+			if err := app.owner.RemoveMember(group, ids[index]); err != nil {
+				utils.LL.Error("RemoveMember: %s", err.Error())
+			}
+			app.closeModal(GROUP_PAGE)
+		}).
+		AddButton("Cancel", func() {
+			app.closeModal(GROUP_PAGE)
+		})
+	form.SetBorder(true).SetTitle(fmt.Sprintf("Remove from %s", groupName))
+	app.pages.AddPage(GROUP_PAGE, modal(form, 55, 7), true, true)
+	app.ui.SetFocus(form)
+}
+
+func (app *App) showPresence() {
+	presence, status := app.owner.Presence()
+	options := make([]string, 0, len(entity.Presences))
+	for _, p := range entity.Presences {
+		options = append(options, p.String())
+	}
+	form := tview.NewForm().
+		AddDropDown("Presence", options, int(presence), func(option string, optionIndex int) {
+			presence = entity.Presences[optionIndex]
+		}).
+		AddInputField("Status", status, 40, nil, func(text string) {
+			status = text
+		})
+	form.AddButton("Save", func() {
+		app.autoAway = false
+		app.owner.SetPresence(presence, status)
+		app.closeModal(PRESENCE_PAGE)
+	}).AddButton("Cancel", func() {
+		app.closeModal(PRESENCE_PAGE)
+	})
+	form.SetBorder(true).SetTitle("Presence")
+	app.pages.AddPage(PRESENCE_PAGE, modal(form, 60, 9), true, true)
+	app.ui.SetFocus(form)
+}
+
+func (app *App) showSettings() {
+	settings := app.owner.Settings.Get()
+	form := tview.NewForm().
+		AddCheckbox("Send typing indicators", settings.TypingIndicators, func(checked bool) {
+			settings.TypingIndicators = checked
+		}).
+		AddCheckbox("Send read receipts", settings.ReadReceipts, func(checked bool) {
+			settings.ReadReceipts = checked
+		})
+	form.AddButton("Save", func() {
+		if err := app.owner.Settings.Set(settings); err != nil {
+			utils.LL.Error("Settings: %s", err.Error())
+		}
+		app.closeModal(SETTINGS_PAGE)
+	}).AddButton("Cancel", func() {
+		app.closeModal(SETTINGS_PAGE)
+	})
+	form.SetBorder(true).SetTitle("Settings")
+	app.pages.AddPage(SETTINGS_PAGE, modal(form, 55, 9), true, true)
+	app.ui.SetFocus(form)
+}
+
+func (app *App) markActive() {
+	app.lastInput = time.Now()
+	if !app.autoAway {
+		return
+	}
+	app.autoAway = false
+	if presence, status := app.owner.Presence(); presence == entity.PresenceAway {
+		app.owner.SetPresence(entity.PresenceOnline, status)
+	}
+}
+
+func (app *App) isFocused() bool {
+	if time.Since(app.lastInput) >= readReceiptWindow {
+		return false
+	}
+	return app.textView.View.HasFocus() || app.textInput.View.HasFocus() || app.sidebar.View.HasFocus()
+}
+
+func (app *App) markRead(room *entity.Room) {
+	visible := app.textView.Visible()
+	if len(visible) == 0 {
+		return
+	}
+	go func() {
+		if err := app.owner.MarkRead(room, visible); err != nil {
+			utils.LL.Error("MarkRead: %s", err.Error())
+		}
+	}()
+}
+
+func (app *App) checkIdle() {
+	if app.autoAway || time.Since(app.lastInput) < autoAwayAfter {
+		return
+	}
+	if presence, status := app.owner.Presence(); presence == entity.PresenceOnline {
+		app.autoAway = true
+		app.owner.SetPresence(entity.PresenceAway, status)
+	}
+}
+
 func (app *App) renderMessages() {
-	timeStr := time.Now().Format("Current time is 15:04:05")
+	if app.currentRoom != nil {
+		if _, found := app.owner.Repo.Get(app.currentRoom.Id); !found {
+			app.setCurrentRoom(nil)
+		}
+	}
+	presence, _ := app.owner.Presence()
+	timeStr := fmt.Sprintf("%s | You are %s", time.Now().Format("Current time is 15:04:05"), presence)
 	app.textView.View.SetTitle(timeStr).
 		SetTitleColor(tcell.ColorGreen)
 	if app.currentRoom != nil {
 		app.textInput.View.SetDisabled(false)
 		app.textView.RenderMessages(app.currentRoom.Messages, app.owner.Name)
-		app.textView.View.SetTitle(fmt.Sprintf("%s | Chatting with %s", timeStr, app.currentRoom.Name))
+		if app.isFocused() {
+			app.markRead(app.currentRoom)
+		}
+		name, _ := app.currentRoom.Info()
+		name = tview.Escape(name)
+		title := fmt.Sprintf("%s | Chatting with %s", timeStr, name)
+		if app.currentRoom.IsTyping() {
+			title += fmt.Sprintf(" | %s is typing…", name)
+		}
+		app.textView.View.SetTitle(title)
 	} else {
 		app.textInput.View.SetDisabled(true)
 	}
@@ -261,13 +771,54 @@ func (app *App) getCurrentRoom() *entity.Room {
 	return room
 }
 
-func (app *App) run() {
-	ticker := time.NewTicker(reprintFrequency)
+func (app *App) notify() {
+	select {
+	case app.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (app *App) appendLog(s string) {
+	app.logMutex.Lock()
+	app.pendingLogs = append(app.pendingLogs, s)
+	app.logMutex.Unlock()
+	app.notify()
+}
+
+func (app *App) flushLogs() {
+	app.logMutex.Lock()
+	logs := app.pendingLogs
+	app.pendingLogs = nil
+	app.logMutex.Unlock()
+	for _, s := range logs {
+		app.loggerView.RenderMessages(s)
+	}
+}
+
+func (app *App) run(ctx context.Context) {
+	unsubscribe := utils.Events.Subscribe(func(e utils.Event) {
+		app.notify()
+	}, utils.EventRoomAdded, utils.EventRoomRemoved, utils.EventRoomUpdated, utils.EventPresenceChanged)
+	ticker := time.NewTicker(clockFrequency)
+	app.notify()
 	go func() {
+		defer func() {
+			ticker.Stop()
+			unsubscribe()
+		}()
 		for {
-			<-ticker.C
-			app.ui.QueueUpdateDraw(app.sidebar.Reprint)
-			app.ui.QueueUpdateDraw(app.renderMessages)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-app.redraw:
+			}
+			app.ui.QueueUpdateDraw(func() {
+				app.flushLogs()
+				app.checkIdle()
+				app.sidebar.Reprint()
+				app.renderMessages()
+			})
 		}
 	}()
 }
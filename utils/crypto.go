@@ -4,57 +4,71 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"math/big"
 )
 
-func GetSecret(PubKey *big.Int, dh DiffieHellman) []byte {
-	return dh.ComputeSecret(PubKey)
+type DecryptError struct {
+	Err error
 }
 
-func EncryptMessage(key []byte, message string) (string, error) {
-	key = key[:32]
-	byteMsg := []byte(message)
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", fmt.Errorf("could not create new cipher: %v", err)
-	}
-
-	cipherText := make([]byte, aes.BlockSize+len(byteMsg))
-	iv := cipherText[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return "", fmt.Errorf("could not encrypt: %v", err)
-	}
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("could not decrypt: %v", e.Err)
+}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], byteMsg)
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
 
-	return base64.StdEncoding.EncodeToString(cipherText), nil
+func GetSecret(peerKey []byte, ka KeyAgreement) ([]byte, error) {
+	return ka.SharedSecret(peerKey)
 }
 
-func DecryptMessage(key []byte, message string) (string, error) {
-	key = key[:32]
-	cipherText, err := base64.StdEncoding.DecodeString(message)
-	if err != nil {
-		return "", fmt.Errorf("could not base64 decode: %v", err)
+func AssociatedData(kind, roomId, senderId, messageId string, counter uint64) []byte {
+	ad := make([]byte, 0, len(kind)+len(roomId)+len(senderId)+len(messageId)+24)
+	for _, field := range []string{kind, roomId, senderId, messageId} {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(len(field)))
+		ad = append(ad, field...)
 	}
+	return binary.BigEndian.AppendUint64(ad, counter)
+}
 
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != secretSize {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", fmt.Errorf("could not create new cipher: %v", err)
+		return nil, fmt.Errorf("could not create new cipher: %v", err)
 	}
+	return cipher.NewGCM(block)
+}
 
-	if len(cipherText) < aes.BlockSize {
-		return "", fmt.Errorf("invalid ciphertext block size")
+func SealMessage(key []byte, message string, ad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
 	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(message)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not encrypt: %v", err)
+	}
+	return aead.Seal(nonce, nonce, []byte(message), ad), nil
+}
 
-	iv := cipherText[:aes.BlockSize]
-	cipherText = cipherText[aes.BlockSize:]
-
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(cipherText, cipherText)
-
-	return string(cipherText), nil
+func OpenMessage(key []byte, cipherText, ad []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", &DecryptError{Err: err}
+	}
+	if len(cipherText) < aead.NonceSize()+aead.Overhead() {
+		return "", &DecryptError{Err: fmt.Errorf("invalid ciphertext size")}
+	}
+	nonce := cipherText[:aead.NonceSize()]
+	plainText, err := aead.Open(nil, nonce, cipherText[aead.NonceSize():], ad)
+	if err != nil {
+		return "", &DecryptError{Err: err}
+	}
+	return string(plainText), nil
 }
@@ -584,3 +584,11 @@ func NewDiffieHellman(group ...int) DiffieHellman {
 	}
 	return dhFromGroup(defaultGroup)
 }
+
+func (dh DiffieHellman) IsValidPublicKey(public *big.Int) bool {
+	if public == nil || dh.p == nil {
+		return false
+	}
+	pMinusOne := new(big.Int).Sub(dh.p, big.NewInt(1))
+	return public.Cmp(big.NewInt(1)) > 0 && public.Cmp(pMinusOne) < 0
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"sync"
+)
+
+type EventKind int
+
+var (
+	Events = NewEventBus()
+)
+
+const (
+	EventRoomAdded EventKind = iota + 1
+	EventRoomRemoved
+	EventRoomUpdated
+	EventMessageReceived
+	EventDeliveryChanged
+	EventLog
+	EventPresenceChanged
+	EventMessageUpdated
+)
+
+type Event struct {
+	Kind      EventKind
+	RoomId    string
+	MessageId string
+	Text      string
+}
+
+type EventBus struct {
+	mutex       sync.RWMutex
+	subscribers map[int]func(e Event)
+	nextId      int
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[int]func(e Event)),
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.mutex.RLock()
+	subscribers := make([]func(e Event), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	b.mutex.RUnlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+func (b *EventBus) Subscribe(fn func(e Event), kinds ...EventKind) func() {
+	if len(kinds) > 0 {
+		handler := fn
+		fn = func(e Event) {
+			for _, kind := range kinds {
+				if e.Kind == kind {
+					handler(e)
+					return
+				}
+			}
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.nextId
+	b.nextId++
+	b.subscribers[id] = fn
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscribers, id)
+	}
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	fingerprintGroups  = 8
+	safetyNumberGroups = 12
+)
+
+func Fingerprint(publicKey []byte) string {
+	hash := sha256.Sum256(publicKey)
+	encoded := hex.EncodeToString(hash[:fingerprintGroups*2])
+	groups := make([]string, 0, fingerprintGroups)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.ToUpper(strings.Join(groups, " "))
+}
+
+func SafetyNumber(a, b []byte) string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	hash := sha512.Sum512(append(append([]byte{}, a...), b...))
+	groups := make([]string, 0, safetyNumberGroups)
+	for i := 0; i < safetyNumberGroups; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], hash[i*5:i*5+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const identityIdSize = 16
+
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		PublicKey:  pub,
+		privateKey: priv,
+	}, nil
+}
+
+func IdentityFromSeed(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity seed size %d", len(seed))
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &Identity{
+		PublicKey:  priv.Public().(ed25519.PublicKey),
+		privateKey: priv,
+	}, nil
+}
+
+func (i *Identity) Seed() []byte {
+	return i.privateKey.Seed()
+}
+
+func (i *Identity) Id() string {
+	return IdentityId(i.PublicKey)
+}
+
+func (i *Identity) Sign(message []byte) []byte {
+	return ed25519.Sign(i.privateKey, message)
+}
+
+func IdentityId(publicKey []byte) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:identityIdSize])
+}
+
+func VerifySignature(publicKey, message, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, message, signature)
+}
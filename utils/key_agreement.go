@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	SchemeX25519   = "x25519"
+	SchemeMODP2048 = "modp2048"
+	secretSize     = 32
+)
+
+var (
+	KeySchemes          = []string{SchemeX25519, SchemeMODP2048}
+	ErrUnknownScheme    = errors.New("ErrorUnknownKeyScheme")
+	ErrInvalidPublicKey = errors.New("ErrorInvalidPublicKey")
+)
+
+type KeyAgreement interface {
+	Scheme() string
+	Public() []byte
+	SharedSecret(peerKey []byte) ([]byte, error)
+}
+
+func NewKeyAgreement(scheme string) (KeyAgreement, error) {
+	switch scheme {
+	case SchemeX25519:
+		return newX25519()
+	case SchemeMODP2048:
+		return NewDiffieHellman(14), nil
+	}
+	return nil, ErrUnknownScheme
+}
+
+func NegotiateScheme(remote []string) (string, bool) {
+	for _, scheme := range KeySchemes {
+		for _, r := range remote {
+			if r == scheme {
+				return scheme, true
+			}
+		}
+	}
+	return "", false
+}
+
+func DeriveSecret(secret, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, secretSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type x25519 struct {
+	privateKey *ecdh.PrivateKey
+}
+
+func newX25519() (*x25519, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &x25519{privateKey: privateKey}, nil
+}
+
+func (x *x25519) Scheme() string {
+	return SchemeX25519
+}
+
+func (x *x25519) Public() []byte {
+	return x.privateKey.PublicKey().Bytes()
+}
+
+func (x *x25519) SharedSecret(peerKey []byte) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	secret, err := x.privateKey.ECDH(public)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	return secret, nil
+}
+
+func (dh DiffieHellman) Scheme() string {
+	return SchemeMODP2048
+}
+
+func (dh DiffieHellman) Public() []byte {
+	return dh.PublicKey.FillBytes(make([]byte, len(dh.p.Bytes())))
+}
+
+func (dh DiffieHellman) SharedSecret(peerKey []byte) ([]byte, error) {
+	public := new(big.Int).SetBytes(peerKey)
+	if !dh.IsValidPublicKey(public) {
+		return nil, ErrInvalidPublicKey
+	}
+	return dh.ComputeSecret(public), nil
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,10 @@ const (
 	ERROR
 )
 
+const (
+	maxPendingLogs = 1000
+)
+
 type LogMessage struct {
 	Level   LogLevel
 	Time    time.Time
@@ -40,57 +45,66 @@ func (s *LogMessage) ToString() string {
 }
 
 type CLogger struct {
-	notification chan *LogMessage
+	mutex    sync.Mutex
+	events   *EventBus
+	attached int
+	pending  []string
 }
 
 func NewCLogger() *CLogger {
 	return &CLogger{
-		notification: make(chan *LogMessage, 10),
+		events: Events,
 	}
 }
 
 func (s *CLogger) Exec(ctx context.Context, fn func(string)) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg, ok := <-s.notification:
-			if !ok {
-				return
-			}
-			fn(msg.ToString())
-		}
+	s.mutex.Lock()
+	unsubscribe := s.events.Subscribe(func(e Event) {
+		fn(e.Text)
+	}, EventLog)
+	for _, line := range s.pending {
+		fn(line)
 	}
+	s.pending = nil
+	s.attached++
+	s.mutex.Unlock()
+	<-ctx.Done()
+	s.mutex.Lock()
+	unsubscribe()
+	s.attached--
+	s.mutex.Unlock()
 }
 
-func (s *CLogger) Debug(format string, a ...any) {
-	s.notification <- &LogMessage{
-		Level:   DEBUG,
+func (s *CLogger) log(level LogLevel, format string, a ...any) {
+	msg := &LogMessage{
+		Level:   level,
 		Time:    time.Now(),
 		Message: fmt.Sprintf(format, a...),
 	}
+	line := msg.ToString()
+	s.mutex.Lock()
+	if s.attached == 0 {
+		if len(s.pending) == maxPendingLogs {
+			s.pending = s.pending[1:]
+		}
+		s.pending = append(s.pending, line)
+	}
+	s.mutex.Unlock()
+	s.events.Publish(Event{Kind: EventLog, Text: line})
+}
+
+func (s *CLogger) Debug(format string, a ...any) {
+	s.log(DEBUG, format, a...)
 }
 
 func (s *CLogger) Info(format string, a ...any) {
-	s.notification <- &LogMessage{
-		Level:   INFO,
-		Time:    time.Now(),
-		Message: fmt.Sprintf(format, a...),
-	}
+	s.log(INFO, format, a...)
 }
 
 func (s *CLogger) Warn(format string, a ...any) {
-	s.notification <- &LogMessage{
-		Level:   WARN,
-		Time:    time.Now(),
-		Message: fmt.Sprintf(format, a...),
-	}
+	s.log(WARN, format, a...)
 }
 
 func (s *CLogger) Error(format string, a ...any) {
-	s.notification <- &LogMessage{
-		Level:   ERROR,
-		Time:    time.Now(),
-		Message: fmt.Sprintf(format, a...),
-	}
+	s.log(ERROR, format, a...)
 }
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoggerDeliversLinesLoggedBeforeExec(t *testing.T) {
+	logger := &CLogger{events: NewEventBus()}
+	logger.Info("before %d", 1)
+	logger.Info("before %d", 2)
+
+	var mutex sync.Mutex
+	lines := make([]string, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.Exec(ctx, func(line string) {
+			mutex.Lock()
+			lines = append(lines, line)
+			mutex.Unlock()
+		})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		mutex.Lock()
+		n := len(lines)
+		mutex.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	logger.Info("after")
+	cancel()
+	<-done
+
+	want := []string{"before 1", "before 2", "after"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %q", len(lines), len(want), lines)
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Fatalf("line %d = %q, want suffix %q", i, line, want[i])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+const (
+	maxSkippedKeys = 1000
+)
+
+var (
+	ErrRatchetKeyGone = errors.New("ErrorRatchetKeyGone")
+	ErrRatchetTooFar  = errors.New("ErrorRatchetTooFar")
+)
+
+func DeriveKey(secret []byte, label string, context ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	for _, c := range context {
+		mac.Write(c)
+	}
+	return mac.Sum(nil)
+}
+
+type Ratchet struct {
+	mutex    sync.Mutex
+	chainKey []byte
+	index    uint64
+	skipped  map[uint64][]byte
+}
+
+func NewRatchet(chainKey []byte) *Ratchet {
+	return &Ratchet{
+		chainKey: chainKey,
+		index:    1,
+		skipped:  make(map[uint64][]byte),
+	}
+}
+
+func step(chainKey []byte) (messageKey, nextChainKey []byte) {
+	return DeriveKey(chainKey, "\x01"), DeriveKey(chainKey, "\x02")
+}
+
+func (r *Ratchet) Next() (uint64, []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	index := r.index
+	messageKey, nextChainKey := step(r.chainKey)
+	r.chainKey = nextChainKey
+	r.index++
+	return index, messageKey
+}
+
+func (r *Ratchet) Open(index uint64, fn func(messageKey []byte) error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if index < r.index {
+		messageKey, found := r.skipped[index]
+		if !found {
+			return ErrRatchetKeyGone
+		}
+		if err := fn(messageKey); err != nil {
+			return err
+		}
+		delete(r.skipped, index)
+		return nil
+	}
+	if index-r.index > maxSkippedKeys {
+		return ErrRatchetTooFar
+	}
+	chainKey := r.chainKey
+	skipped := make(map[uint64][]byte)
+	for i := r.index; i < index; i++ {
+		var messageKey []byte
+		messageKey, chainKey = step(chainKey)
+		skipped[i] = messageKey
+	}
+	messageKey, chainKey := step(chainKey)
+	if err := fn(messageKey); err != nil {
+		return err
+	}
+	r.chainKey = chainKey
+	r.index = index + 1
+	for i, key := range skipped {
+		r.skipped[i] = key
+	}
+	for i := range r.skipped {
+		if r.index-i > maxSkippedKeys {
+			delete(r.skipped, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newRatchetPair() (*Ratchet, *Ratchet) {
+	chainKey := bytes.Repeat([]byte{0x42}, 32)
+	return NewRatchet(append([]byte{}, chainKey...)), NewRatchet(append([]byte{}, chainKey...))
+}
+
+func sealNext(t *testing.T, r *Ratchet, plainText string) (uint64, []byte, []byte) {
+	t.Helper()
+	index, messageKey := r.Next()
+	cipherText, err := SealMessage(messageKey, plainText, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index, messageKey, cipherText
+}
+
+func openWith(r *Ratchet, index uint64, cipherText []byte) (string, error) {
+	var plainText string
+	err := r.Open(index, func(messageKey []byte) error {
+		var err error
+		plainText, err = OpenMessage(messageKey, cipherText, nil)
+		return err
+	})
+	return plainText, err
+}
+
+func TestRatchetOldKeysCannotOpenLaterMessages(t *testing.T) {
+	send, recv := newRatchetPair()
+	oldChainKey := append([]byte{}, send.chainKey...)
+	index, oldMessageKey, cipherText := sealNext(t, send, "first")
+	if _, err := openWith(recv, index, cipherText); err != nil {
+		t.Fatal(err)
+	}
+	index, _, cipherText = sealNext(t, send, "second")
+	if _, err := OpenMessage(oldMessageKey, cipherText, nil); err == nil {
+		t.Fatal("old message key opened a later message")
+	}
+	if _, err := OpenMessage(oldChainKey, cipherText, nil); err == nil {
+		t.Fatal("old chain key opened a later message")
+	}
+	if plainText, err := openWith(recv, index, cipherText); err != nil || plainText != "second" {
+		t.Fatalf("Open = %q, %v", plainText, err)
+	}
+}
+
+func TestRatchetReplayIsRejected(t *testing.T) {
+	send, recv := newRatchetPair()
+	index, _, cipherText := sealNext(t, send, "once")
+	if _, err := openWith(recv, index, cipherText); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openWith(recv, index, cipherText); !errors.Is(err, ErrRatchetKeyGone) {
+		t.Fatalf("replay = %v, want ErrRatchetKeyGone", err)
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	send, recv := newRatchetPair()
+	type sealed struct {
+		index      uint64
+		cipherText []byte
+	}
+	messages := make([]sealed, 0, 5)
+	for i := 0; i < 5; i++ {
+		index, _, cipherText := sealNext(t, send, "message")
+		messages = append(messages, sealed{index, cipherText})
+	}
+	for _, i := range []int{4, 1, 3, 0, 2} {
+		if _, err := openWith(recv, messages[i].index, messages[i].cipherText); err != nil {
+			t.Fatalf("message %d: %v", messages[i].index, err)
+		}
+	}
+	if _, err := openWith(recv, messages[1].index, messages[1].cipherText); !errors.Is(err, ErrRatchetKeyGone) {
+		t.Fatalf("skipped key reused: %v", err)
+	}
+}
+
+func TestRatchetFailedOpenKeepsState(t *testing.T) {
+	send, recv := newRatchetPair()
+	index, _, cipherText := sealNext(t, send, "real")
+	if _, err := openWith(recv, index, []byte("forged ciphertext that is long enough")); err == nil {
+		t.Fatal("forged message opened")
+	}
+	if _, err := openWith(recv, index, cipherText); err != nil {
+		t.Fatalf("genuine message after forgery: %v", err)
+	}
+}
+
+func TestRatchetTooFar(t *testing.T) {
+	send, recv := newRatchetPair()
+	var index uint64
+	var cipherText []byte
+	for i := 0; i < maxSkippedKeys+2; i++ {
+		index, _, cipherText = sealNext(t, send, "message")
+	}
+	if _, err := openWith(recv, index, cipherText); !errors.Is(err, ErrRatchetTooFar) {
+		t.Fatalf("jump of %d = %v, want ErrRatchetTooFar", index-1, err)
+	}
+	if _, err := openWith(recv, maxSkippedKeys+1, nil); errors.Is(err, ErrRatchetTooFar) {
+		t.Fatal("jump within maxSkippedKeys rejected as too far")
+	}
+}
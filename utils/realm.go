@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	realmSalt = "chat_tool realm"
+	realmN    = 1 << 15
+	realmR    = 8
+	realmP    = 1
+)
+
+var (
+	realmMagic      = []byte("CTR1")
+	ErrForeignRealm = errors.New("ErrorForeignRealm")
+)
+
+type Realm struct {
+	key []byte
+}
+
+func NewRealm(passphrase string) (*Realm, error) {
+	if passphrase == "" {
+		return nil, nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), []byte(realmSalt), realmN, realmR, realmP, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &Realm{
+		key: key,
+	}, nil
+}
+
+func (r *Realm) Seal(packet []byte) ([]byte, error) {
+	if r == nil {
+		return packet, nil
+	}
+	sealed, err := SealMessage(r.key, string(packet), realmMagic)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, realmMagic...), sealed...), nil
+}
+
+func (r *Realm) Open(packet []byte) ([]byte, error) {
+	sealed := bytes.HasPrefix(packet, realmMagic)
+	if r == nil {
+		if sealed {
+			return nil, ErrForeignRealm
+		}
+		return packet, nil
+	}
+	if !sealed {
+		return nil, ErrForeignRealm
+	}
+	plainText, err := OpenMessage(r.key, packet[len(realmMagic):], realmMagic)
+	if err != nil {
+		return nil, ErrForeignRealm
+	}
+	return []byte(plainText), nil
+}
@@ -0,0 +1,33 @@
+package utils
+
+import "sync"
+
+type RecentSet struct {
+	mutex sync.Mutex
+	size  int
+	ids   map[string]struct{}
+	order []string
+}
+
+func NewRecentSet(size int) *RecentSet {
+	return &RecentSet{
+		size:  size,
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, 0, size),
+	}
+}
+
+func (s *RecentSet) Add(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, found := s.ids[id]; found {
+		return false
+	}
+	if len(s.order) == s.size {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[id] = struct{}{}
+	s.order = append(s.order, id)
+	return true
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+const replayWindowSize = 64
+
+var (
+	ErrReplayedMessage = errors.New("ErrorReplayedMessage")
+)
+
+type ReplayWindow struct {
+	mutex   sync.Mutex
+	highest uint64
+	bitmap  uint64
+}
+
+func NewReplayWindow() *ReplayWindow {
+	return &ReplayWindow{}
+}
+
+func (w *ReplayWindow) Check(counter uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.check(counter)
+}
+
+func (w *ReplayWindow) Accept(counter uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.check(counter); err != nil {
+		return err
+	}
+	if counter > w.highest {
+		shift := counter - w.highest
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.highest = counter
+		return nil
+	}
+	w.bitmap |= 1 << (w.highest - counter)
+	return nil
+}
+
+func (w *ReplayWindow) Reset() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.highest = 0
+	w.bitmap = 0
+}
+
+func (w *ReplayWindow) check(counter uint64) error {
+	if counter == 0 {
+		return ErrReplayedMessage
+	}
+	if counter > w.highest {
+		return nil
+	}
+	offset := w.highest - counter
+	if offset >= replayWindowSize || w.bitmap&(1<<offset) != 0 {
+		return ErrReplayedMessage
+	}
+	return nil
+}
@@ -4,9 +4,9 @@ import "net"
 
 func ReadFromUDPConnection(conn *net.UDPConn, bufferSize int) ([]byte, *net.UDPAddr, error) {
 	buffer := make([]byte, bufferSize)
-	_, src, err := conn.ReadFromUDP(buffer)
+	n, src, err := conn.ReadFromUDP(buffer)
 	if err != nil {
 		return nil, nil, err
 	}
-	return buffer, src, nil
+	return buffer[:n], src, nil
 }